@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	"github.com/archa347/ps-network-test/liveness"
+	"github.com/archa347/ps-network-test/redis"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+// migrate moves keys written by older releases into the current redis
+// layout.  Run it once after deploying a release that changes the layout;
+// running it again is a no-op.
+func main() {
+	cfg := config.New()
+
+	dryRun := flag.Bool("dry-run", false, "print the planned changes without making them")
+	namespace := flag.String("namespace", cfg.Namespace, "namespace to migrate keys into")
+	flag.Parse()
+
+	redisClient, err := redis.RedisClient(cfg)
+	if err != nil {
+		log.WithError(err).Error("Unable to create redis client")
+		os.Exit(1)
+	}
+	ctx := context.Background()
+
+	if *dryRun {
+		migrations, err := liveness.PlanMigration(ctx, redisClient, *namespace)
+		if err != nil {
+			log.WithError(err).Error("Unable to plan migration")
+			os.Exit(1)
+		}
+		if len(migrations) == 0 {
+			fmt.Printf("%v is already at schema version %v\n", *namespace, liveness.SchemaVersion)
+			return
+		}
+		for _, migration := range migrations {
+			fmt.Println(migration)
+		}
+		fmt.Printf("%v keys would be migrated to schema version %v in %v\n", len(migrations), liveness.SchemaVersion, *namespace)
+		return
+	}
+
+	moved, err := liveness.Migrate(ctx, redisClient, *namespace)
+	if err != nil {
+		log.WithError(err).WithField("moved", moved).Error("Migration failed, run it again to resume")
+		os.Exit(1)
+	}
+	fmt.Printf("%v keys migrated to schema version %v in %v\n", moved, liveness.SchemaVersion, *namespace)
+}
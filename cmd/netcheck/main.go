@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	"github.com/archa347/ps-network-test/liveness"
+	"github.com/archa347/ps-network-test/redis"
+	"github.com/carlmjohnson/requests"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// netcheck prints the network report in a terminal, and exits 1 if no dyno
+// is reporting or any check it shows is failing or stale, so it can gate a
+// deploy.
+//
+//	netcheck -url https://my-app.herokuapp.com -failing
+//	netcheck -redis -category private,latency -view matrix
+func main() {
+	url := flag.String("url", "", "base URL of a running app to read /report.json from")
+	fromRedis := flag.Bool("redis", false, "read the report straight from redis, configured like the app")
+	dyno := flag.String("dyno", "", "only show these dynos (comma separated)")
+	category := flag.String("category", "", "only show these categories (comma separated): dmz, nat, private, dns, latency, throughput, udp, redis, cert, manual")
+	failing := flag.Bool("failing", false, "only show failing checks, which include stale ones unless -allow-stale")
+	allowStale := flag.Bool("allow-stale", false, "don't count stale checks as failing")
+	view := flag.String("view", "table", "table, or matrix for dyno-to-dyno categories")
+	noColor := flag.Bool("no-color", false, "disable color")
+	timeout := flag.Duration("timeout", 30*time.Second, "how long to wait for the report")
+	flag.Parse()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	var dynos []liveness.Report
+	var err error
+	switch {
+	case *url != "":
+		dynos, err = fetchReport(ctx, *url)
+	case *fromRedis:
+		dynos, err = readReport(ctx)
+	default:
+		err = fmt.Errorf("one of -url or -redis is required")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "netcheck:", err)
+		os.Exit(2)
+	}
+	if len(dynos) == 0 {
+		fmt.Fprintln(os.Stderr, "netcheck: no dynos are reporting")
+		os.Exit(1)
+	}
+
+	f := filter{
+		dynos:      splitFlag(*dyno),
+		categories: splitFlag(*category),
+		failing:    *failing,
+		allowStale: *allowStale,
+	}
+	out := printer{w: os.Stdout, color: !*noColor && colorable()}
+
+	dynos = f.apply(dynos)
+	if *view == "matrix" {
+		out.matrices(dynos)
+	} else {
+		out.tables(dynos)
+	}
+
+	failed := 0
+	for _, report := range dynos {
+		for _, category := range report.Categories() {
+			for _, check := range category.Checks {
+				if f.fails(check) {
+					failed++
+				}
+			}
+		}
+	}
+	if failed > 0 {
+		fmt.Fprintf(os.Stdout, "\n%v failing checks\n", failed)
+		os.Exit(1)
+	}
+}
+
+func fetchReport(ctx context.Context, url string) ([]liveness.Report, error) {
+	var report struct {
+		Dynos []liveness.Report `json:"dynos"`
+	}
+	err := requests.
+		URL(url).
+		Path("/report.json").
+		ToJSON(&report).
+		Fetch(ctx)
+	return report.Dynos, err
+}
+
+func readReport(ctx context.Context) ([]liveness.Report, error) {
+	cfg := config.New()
+	client, err := redis.RedisClient(cfg)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	checker := liveness.NewChecker(cfg, client, nil, nil, liveness.NewWriteBuffer(cfg, client))
+	return checker.ReadReport(ctx)
+}
+
+func splitFlag(value string) map[string]bool {
+	set := make(map[string]bool)
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			set[item] = true
+		}
+	}
+	return set
+}
+
+type filter struct {
+	dynos      map[string]bool
+	categories map[string]bool
+	failing    bool
+	allowStale bool
+}
+
+// fails reports whether check counts as failing.  A stale check hasn't run
+// when it should have, so it can't vouch for the network either.
+func (f filter) fails(check liveness.CheckReport) bool {
+	state := check.State()
+	return state == "fail" || (state == "stale" && !f.allowStale)
+}
+
+func (f filter) apply(reports []liveness.Report) []liveness.Report {
+	var filtered []liveness.Report
+	for _, report := range reports {
+		if len(f.dynos) > 0 && !f.dynos[report.Dyno] {
+			continue
+		}
+		kept := liveness.Report{Dyno: report.Dyno, Clock: report.Clock}
+		shown := 0
+		for _, category := range report.Categories() {
+			if len(f.categories) > 0 && !f.categories[category.Name] {
+				continue
+			}
+			for _, check := range category.Checks {
+				if f.failing && !f.fails(check) {
+					continue
+				}
+				kept.Add(category.Name, check)
+				shown++
+			}
+		}
+		if shown == 0 && (f.failing || len(f.categories) > 0) {
+			continue
+		}
+		filtered = append(filtered, kept)
+	}
+	return filtered
+}
+
+// colorable reports whether stdout is a terminal that hasn't opted out of
+// color with NO_COLOR.
+func colorable() bool {
+	if _, set := os.LookupEnv("NO_COLOR"); set {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+var colors = map[string]string{
+	"pass":  "\033[32m",
+	"warn":  "\033[33m",
+	"fail":  "\033[31m",
+	"stale": "\033[90m",
+}
+
+type printer struct {
+	w     io.Writer
+	color bool
+}
+
+func (p printer) paint(state string, text string) string {
+	if !p.color {
+		return text
+	}
+	return colors[state] + text + "\033[0m"
+}
+
+func (p printer) tables(reports []liveness.Report) {
+	for _, report := range reports {
+		fmt.Fprintf(p.w, "== %v\n", report.Dyno)
+		if clock := report.Clock; clock != nil {
+			state := "pass"
+			if clock.Skewed {
+				state = "warn"
+			}
+			fmt.Fprintln(p.w, p.paint(state, fmt.Sprintf("clock offset %v from redis", clock.Redis)))
+		}
+		// Color codes would throw off tabwriter's widths, so the status
+		// column is padded by hand and painted after.
+		tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "CATEGORY\tDESTINATION\tSTATUS\tAGE\tRESULT")
+		for _, category := range report.Categories() {
+			for _, check := range category.Checks {
+				state := check.State()
+				fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\n", category.Name, check.Dest, p.paint(state, fmt.Sprintf("%-5v", state)), check.Age, check.Result)
+			}
+		}
+		tw.Flush()
+		fmt.Fprintln(p.w)
+	}
+}
+
+// matrices prints each dyno-to-dyno category as a grid of source dynos
+// against destination dynos.
+func (p printer) matrices(reports []liveness.Report) {
+	for _, name := range []string{"private", "latency", "throughput", "udp"} {
+		cells := make(map[string]map[string]string)
+		destSet := make(map[string]bool)
+		for _, report := range reports {
+			for _, category := range report.Categories() {
+				if category.Name != name {
+					continue
+				}
+				for _, check := range category.Checks {
+					if cells[report.Dyno] == nil {
+						cells[report.Dyno] = make(map[string]string)
+					}
+					cells[report.Dyno][check.Dest] = check.State()
+					destSet[check.Dest] = true
+				}
+			}
+		}
+		if len(cells) == 0 {
+			continue
+		}
+		var dests []string
+		for dest := range destSet {
+			dests = append(dests, dest)
+		}
+		sort.Strings(dests)
+
+		width := len("src\\dest")
+		for _, dest := range dests {
+			if len(dest) > width {
+				width = len(dest)
+			}
+		}
+		for dyno := range cells {
+			if len(dyno) > width {
+				width = len(dyno)
+			}
+		}
+		fmt.Fprintf(p.w, "== %v\n", name)
+		fmt.Fprintf(p.w, "%-*v", width+2, "src\\dest")
+		for _, dest := range dests {
+			fmt.Fprintf(p.w, "%-*v", width+2, dest)
+		}
+		fmt.Fprintln(p.w)
+		for _, report := range reports {
+			row, ok := cells[report.Dyno]
+			if !ok {
+				continue
+			}
+			fmt.Fprintf(p.w, "%-*v", width+2, report.Dyno)
+			for _, dest := range dests {
+				state, ok := row[dest]
+				if !ok {
+					fmt.Fprintf(p.w, "%-*v", width+2, "-")
+					continue
+				}
+				fmt.Fprint(p.w, p.paint(state, fmt.Sprintf("%-*v", width+2, state)))
+			}
+			fmt.Fprintln(p.w)
+		}
+		fmt.Fprintln(p.w)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	"github.com/archa347/ps-network-test/liveness"
+	"github.com/archa347/ps-network-test/mtls"
+	"github.com/archa347/ps-network-test/redis"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"strings"
+	"time"
+)
+
+// probe runs a single check from the current dyno and prints everything it
+// found, for debugging from `heroku run` with the same semantics as the
+// scheduled checks.
+//
+//	probe -type nat -dest https://api.example.com
+//	probe -type private -dest web.2.my-app.app.localspace -record
+//	probe -type dns -dest example.com@8.8.8.8:53/tcp
+func main() {
+	probeType := flag.String("type", "", "probe to run: "+strings.Join(liveness.ProbeTypes, ", "))
+	dest := flag.String("dest", "", "destination to probe: a URL or target name, a peer dyno, or a DNS name")
+	record := flag.Bool("record", false, "store the result in redis under the manual category")
+	asJSON := flag.Bool("json", false, "print the result as JSON")
+	timeout := flag.Duration("timeout", time.Minute, "how long to let the probe run")
+	flag.Parse()
+
+	if *probeType == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	cfg := config.New()
+	redisClient, err := redis.RedisClient(cfg)
+	if err != nil {
+		log.WithError(err).Error("Unable to create redis client")
+		os.Exit(2)
+	}
+	privateTLS, err := mtls.Load(cfg)
+	if err != nil {
+		log.WithError(err).Error("Unable to load private TLS config")
+		os.Exit(2)
+	}
+	checker := liveness.NewChecker(cfg, redisClient, privateTLS.Client, nil, liveness.NewWriteBuffer(cfg, redisClient))
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	probe, err := checker.Probe(ctx, *probeType, *dest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "probe:", err)
+		os.Exit(2)
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(probe, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		fmt.Printf("type:    %v\n", probe.Type)
+		fmt.Printf("dest:    %v\n", probe.Dest)
+		fmt.Printf("result:  %v\n", probe.Result)
+		fmt.Printf("elapsed: %v\n", probe.Elapsed.Round(time.Microsecond))
+		if probe.Class != "" {
+			fmt.Printf("class:   %v\n", probe.Class)
+		}
+		if probe.Error != "" {
+			fmt.Printf("error:   %v\n", probe.Error)
+		}
+		if probe.HTTP != nil {
+			fmt.Printf("http:    %v\n", probe.HTTP)
+		}
+		if probe.Cert != "" {
+			fmt.Printf("cert:    %v\n", probe.Cert)
+		}
+	}
+
+	if *record {
+		err = checker.RecordProbe(ctx, probe)
+		if err != nil {
+			log.WithError(err).Error("Unable to record probe result")
+			os.Exit(2)
+		}
+	}
+
+	if !probe.Passed() {
+		os.Exit(1)
+	}
+}
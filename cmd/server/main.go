@@ -1,22 +1,81 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"github.com/archa347/ps-network-test/config"
+	"github.com/archa347/ps-network-test/gossip"
 	"github.com/archa347/ps-network-test/liveness"
+	"github.com/archa347/ps-network-test/mtls"
 	"github.com/archa347/ps-network-test/redis"
 	"github.com/gin-gonic/gin"
 	_ "github.com/heroku/x/hmetrics/onload"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"time"
 )
 
 func main() {
 	cfg := config.New()
 
-	redisClient := redis.RedisClient(cfg)
+	redisClient, err := redis.RedisClient(cfg)
+	if err != nil {
+		log.WithError(err).Error("Unable to create redis client")
+		os.Exit(1)
+	}
+	err = redisClient.Ping(context.Background()).Err()
+	if redis.IsCertificateError(err) {
+		// Retrying won't help, and the write buffer would otherwise hide
+		// the failure behind a steady stream of buffered writes.
+		hint := "Heroku Redis presents a self-signed certificate, so set REDIS_TLS_MODE=pin (with REDIS_TLS_PIN) or REDIS_TLS_MODE=ca (with REDIS_TLS_CA)"
+		if cfg.RedisTLSMode == redis.TLSPin {
+			hint = "REDIS_TLS_PIN doesn't match the server's certificate; it may have been rotated"
+		}
+		log.WithError(err).WithField("tls_mode", cfg.RedisTLSMode).Error("Redis server certificate rejected; " + hint)
+		os.Exit(1)
+	}
+	if err != nil {
+		log.WithError(err).WithField("tls_mode", cfg.RedisTLSMode).Error("Unable to connect to redis")
+	} else {
+		err = liveness.InitSchema(context.Background(), redisClient, cfg.Namespace)
+		if err != nil {
+			log.WithError(err).Warn("Unable to initialise redis schema version")
+		}
+	}
+
+	privateTLS, err := mtls.Load(cfg)
+	if err != nil {
+		log.WithError(err).Error("Unable to load private TLS config")
+		os.Exit(1)
+	}
+
+	writeBuffer := liveness.NewWriteBuffer(cfg, redisClient)
 
-	livenessReporter := liveness.NewReporter(cfg, redisClient)
-	livenessChecker := liveness.NewChecker(cfg, redisClient)
+	livenessReporter := liveness.NewReporter(cfg, redisClient, writeBuffer)
+	web := cfg.HasRole(config.RoleWeb)
+	prober := cfg.HasRole(config.RoleProber)
+	log.WithField("roles", strings.Join(cfg.Roles, ",")).Info("Starting")
+
+	var gossipNode *gossip.Node
+	if prober && cfg.GossipEnabled && cfg.PrivateIP != "" {
+		gossipNode, err = gossip.New(gossip.Config{
+			ID:            cfg.DynoID,
+			BindAddr:      cfg.PrivateIP + ":" + cfg.GossipPort,
+			AdvertiseAddr: cfg.PrivateIP + ":" + cfg.GossipPort,
+			Interval:      time.Duration(cfg.GossipIntervalMS) * time.Millisecond,
+		})
+		if err != nil {
+			log.WithError(err).Error("Unable to start gossip")
+			os.Exit(1)
+		}
+	}
+
+	livenessChecker := liveness.NewChecker(cfg, redisClient, privateTLS.Client, gossipNode, writeBuffer)
 
 	router := gin.New()
 	router.Use(gin.Logger())
@@ -39,23 +98,142 @@ func main() {
 		c.HTML(200, "report.tmpl.html", livenessChecker.Report(c))
 	})
 
-	livenessReporter.Start()
-	livenessChecker.Start()
+	router.GET("/report.json", func(c *gin.Context) {
+		c.JSON(200, livenessChecker.Report(c))
+	})
+
+	events := liveness.NewEventStream(cfg, redisClient)
+	router.GET("/report/events", func(c *gin.Context) {
+		ch, unsubscribe := events.Subscribe()
+		defer unsubscribe()
+
+		// Heroku's router closes connections idle for 55 seconds.
+		keepalive := time.NewTicker(30 * time.Second)
+		defer keepalive.Stop()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case event := <-ch:
+				c.SSEvent(event.Type, event)
+				return true
+			case <-keepalive.C:
+				c.SSEvent("keepalive", "")
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	})
+
+	router.GET("/report/history", func(c *gin.Context) {
+		c.HTML(200, "history.tmpl.html", livenessChecker.History(c, c.Query("dyno"), c.Query("type"), c.Query("dest"), c.Query("window")))
+	})
+
+	router.GET("/report/federated", func(c *gin.Context) {
+		c.HTML(200, "federated.tmpl.html", livenessChecker.FederatedReport(c))
+	})
+
+	privateIP := cfg.PrivateIP
+
+	throughput := router.Group("/throughput", privateOnly(privateIP))
+
+	// On-demand tests move a lot of data, so they can only be started from
+	// inside the space, e.g. with curl from a one-off dyno.
+	throughput.POST("", func(c *gin.Context) {
+		result, err := livenessChecker.CheckThroughput(c, c.Query("peer"))
+		if errors.Is(err, liveness.ErrUnknownPeer) {
+			c.String(400, err.Error())
+			return
+		}
+		if errors.Is(err, liveness.ErrThroughputBusy) {
+			c.String(409, err.Error())
+			return
+		}
+		if err != nil {
+			c.String(500, err.Error())
+			return
+		}
+		c.String(200, result)
+	})
+
+	// Web and prober dynos both heartbeat and answer private probes, so
+	// either can be probed; only probers run the checks.  A dyno with
+	// just the aggregator role serves nothing.
+	writeBuffer.Start()
+	if web || prober {
+		livenessReporter.Start()
+	}
+	if web {
+		events.Start()
+	}
+	if prober {
+		livenessChecker.Start()
+	}
+	if gossipNode != nil {
+		gossipNode.Start()
+		livenessChecker.StartGossipJoin()
+	}
+	if cfg.HasRole(config.RoleAggregator) {
+		liveness.NewAggregator(cfg, redisClient, livenessChecker).Start()
+	}
 
 	wg := sync.WaitGroup{}
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		router.Run(":" + cfg.Port)
-	}()
-	privateIP := os.Getenv("HEROKU_PRIVATE_IP")
-	if privateIP != "" {
+	if web {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			router.Run(privateIP + ":7777")
+
+			router.Run(":" + cfg.Port)
 		}()
 	}
+	if (web || prober) && privateIP != "" {
+		go func() {
+			err := liveness.ServeUDPEcho(privateIP + ":" + cfg.UDPEchoPort)
+			if err != nil {
+				log.WithError(err).Error("UDP echo responder stopped")
+			}
+		}()
+		go func() {
+			err := liveness.ServeThroughput(privateIP+":"+cfg.ThroughputPort, privateTLS.Server)
+			if err != nil {
+				log.WithError(err).Error("Throughput service stopped")
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !privateTLS.Enabled() {
+				router.Run(privateIP + ":7777")
+				return
+			}
+			server := &http.Server{
+				Addr:      privateIP + ":7777",
+				Handler:   router,
+				TLSConfig: privateTLS.Server,
+			}
+			err := server.ListenAndServeTLS("", "")
+			if err != nil {
+				log.WithError(err).Error("Private TLS listener stopped")
+			}
+		}()
+	}
+	if !web && (!prober || privateIP == "") {
+		// Nothing to serve, so just keep the crons running.
+		select {}
+	}
 	wg.Wait()
 }
+
+// privateOnly rejects requests that didn't arrive on the private listener,
+// since the public and private listeners share a router.
+func privateOnly(privateIP string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		addr, ok := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr)
+		if !ok || privateIP == "" || !strings.HasPrefix(addr.String(), privateIP+":") {
+			c.AbortWithStatus(404)
+			return
+		}
+		c.Next()
+	}
+}
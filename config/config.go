@@ -4,20 +4,82 @@ import (
 	"fmt"
 	"github.com/joho/godotenv"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
-	Port               string
-	DynoID             string
-	RedisURL           string
-	LivenessIntervalMS int
-	LivenessTimeoutMS  int
-	AppName            string
-	PrivateCheckCron   string
-	DMZCheckCron       string
-	NATCheckCron       string
+	Port                  string
+	DynoID                string
+	RedisURL              string
+	RedisMode             string
+	RedisAddrs            []string
+	RedisMasterName       string
+	RedisSentinelPassword string
+	LivenessIntervalMS    int
+	LivenessTimeoutMS     int
+	AppName               string
+	Namespace             string
+	PrivateCheckCron      string
+	DMZCheckCron          string
+	NATCheckCron          string
+	PrivateTLS            bool
+	PrivateTLSCert        string
+	PrivateTLSKey         string
+	PrivateTLSCA          string
+	RedisTLSMode          string
+	RedisTLSCA            string
+	RedisTLSPin           string
+	CertExpiryWarnDays    []int
+	Targets               []Target
+	UDPEchoPort           string
+	UDPCheckCron          string
+	UDPBurstCount         int
+	ThroughputCron        string
+	ThroughputBytes       int64
+	ThroughputSeconds     int
+	ThroughputPort        string
+	LatencyCheckCron      string
+	LatencySamples        int
+	DNSCheckCron          string
+	DNSResolvers          []string
+	DNSNames              []string
+	PeerDiscovery         string
+	PeerDNSName           string
+	PrivateIP             string
+	GossipEnabled         bool
+	GossipPort            string
+	GossipIntervalMS      int
+	RedisBufferSize       int
+	RedisCheckCron        string
+	RedisLatencyWarnMS    int
+	Roles                 []string
+	AggregatorCron        string
+	HistoryLength         int
+	SLOTarget             float64
+	AlertAfter            int
+	AlertWebhookURL       string
+	NTPServer             string
+	ClockSkewWarnMS       int
+}
+
+// Roles a process can run as.  A dyno can take several; the default of web
+// and prober is everything but the aggregator.
+const (
+	RoleWeb        = "web"
+	RoleProber     = "prober"
+	RoleAggregator = "aggregator"
+)
+
+func (c Config) HasRole(role string) bool {
+	for _, r := range c.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
 }
 
 func New() Config {
@@ -45,6 +107,46 @@ func New() Config {
 		log.Error("REDIS_URL not found")
 		os.Exit(1)
 	}
+	cfg.RedisMode, set = os.LookupEnv("REDIS_MODE")
+	if !set || cfg.RedisMode == "" {
+		cfg.RedisMode = "single"
+	}
+	cfg.RedisAddrs = splitList(os.Getenv("REDIS_ADDRS"))
+	cfg.RedisMasterName = os.Getenv("REDIS_MASTER_NAME")
+	cfg.RedisSentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+
+	cfg.RedisTLSMode, set = os.LookupEnv("REDIS_TLS_MODE")
+	if !set || cfg.RedisTLSMode == "" {
+		cfg.RedisTLSMode = "verify"
+	}
+	cfg.RedisTLSCA = os.Getenv("REDIS_TLS_CA")
+	cfg.RedisTLSPin = os.Getenv("REDIS_TLS_PIN")
+
+	bufferSize, set := os.LookupEnv("REDIS_BUFFER_SIZE")
+	if !set {
+		bufferSize = "1000"
+	}
+	cfg.RedisBufferSize, err = strconv.Atoi(bufferSize)
+	if err != nil || cfg.RedisBufferSize <= 0 {
+		log.Error("Invalid REDIS_BUFFER_SIZE.  Must be a positive integer")
+		os.Exit(1)
+	}
+
+	cfg.RedisCheckCron, set = os.LookupEnv("REDIS_CHECK_CRON")
+	if !set {
+		cfg.RedisCheckCron = "0/30 * * * * *"
+	}
+
+	latencyWarn, set := os.LookupEnv("REDIS_LATENCY_WARN_MS")
+	if !set {
+		latencyWarn = "100"
+	}
+	cfg.RedisLatencyWarnMS, err = strconv.Atoi(latencyWarn)
+	if err != nil || cfg.RedisLatencyWarnMS <= 0 {
+		log.Error("Invalid REDIS_LATENCY_WARN_MS.  Must be a positive integer")
+		os.Exit(1)
+	}
+
 	intvstring, set := os.LookupEnv("LIVENESS_INTERVAL_MS")
 	if !set {
 		intvstring = "10000"
@@ -63,6 +165,16 @@ func New() Config {
 
 	cfg.AppName = fmt.Sprintf("ps-network-test")
 
+	// Apps sharing a redis keep their keys apart under a namespace, which
+	// defaults to the Heroku app name when dyno metadata is enabled.
+	cfg.Namespace, set = os.LookupEnv("REDIS_NAMESPACE")
+	if !set {
+		cfg.Namespace, set = os.LookupEnv("HEROKU_APP_NAME")
+		if !set {
+			cfg.Namespace = cfg.AppName
+		}
+	}
+
 	cfg.DMZCheckCron, set = os.LookupEnv("DMZ_CHECK_CRON")
 	if !set {
 		cfg.DMZCheckCron = "0/15 * * * * *"
@@ -78,5 +190,253 @@ func New() Config {
 		cfg.PrivateCheckCron = "0 * * * * *"
 	}
 
+	cfg.UDPEchoPort, set = os.LookupEnv("UDP_ECHO_PORT")
+	if !set {
+		cfg.UDPEchoPort = "7778"
+	}
+
+	cfg.UDPCheckCron, set = os.LookupEnv("UDP_CHECK_CRON")
+	if !set {
+		cfg.UDPCheckCron = "30 * * * * *"
+	}
+
+	burstStr, set := os.LookupEnv("UDP_BURST_COUNT")
+	if !set {
+		burstStr = "50"
+	}
+	cfg.UDPBurstCount, err = strconv.Atoi(burstStr)
+	if err != nil || cfg.UDPBurstCount <= 0 {
+		log.Error("Invalid UDP_BURST_COUNT.  Must be a positive integer")
+		os.Exit(1)
+	}
+
+	cfg.LatencyCheckCron, set = os.LookupEnv("LATENCY_CHECK_CRON")
+	if !set {
+		cfg.LatencyCheckCron = "0/20 * * * * *"
+	}
+
+	samplesStr, set := os.LookupEnv("LATENCY_SAMPLES")
+	if !set {
+		samplesStr = "10"
+	}
+	cfg.LatencySamples, err = strconv.Atoi(samplesStr)
+	if err != nil || cfg.LatencySamples <= 0 {
+		log.Error("Invalid LATENCY_SAMPLES.  Must be a positive integer")
+		os.Exit(1)
+	}
+
+	cfg.DNSCheckCron, set = os.LookupEnv("DNS_CHECK_CRON")
+	if !set {
+		cfg.DNSCheckCron = "45 * * * * *"
+	}
+
+	resolvers, set := os.LookupEnv("DNS_RESOLVERS")
+	if set {
+		cfg.DNSResolvers = splitList(resolvers)
+	} else {
+		cfg.DNSResolvers = systemResolvers("/etc/resolv.conf")
+	}
+	for i, resolver := range cfg.DNSResolvers {
+		if _, _, err := net.SplitHostPort(resolver); err != nil {
+			cfg.DNSResolvers[i] = net.JoinHostPort(resolver, "53")
+		}
+	}
+	cfg.DNSNames = splitList(os.Getenv("DNS_NAMES"))
+
+	cfg.PrivateIP = os.Getenv("HEROKU_PRIVATE_IP")
+
+	cfg.PeerDNSName = os.Getenv("PEER_DNS_NAME")
+	cfg.PeerDiscovery, set = os.LookupEnv("PEER_DISCOVERY")
+	if !set || cfg.PeerDiscovery == "" {
+		cfg.PeerDiscovery = "redis"
+	}
+	if cfg.PeerDiscovery != "redis" && cfg.PeerDiscovery != "dns" {
+		log.Error("Invalid PEER_DISCOVERY.  Must be redis or dns")
+		os.Exit(1)
+	}
+	if cfg.PeerDiscovery == "dns" && cfg.PeerDNSName == "" {
+		log.Error("PEER_DNS_NAME must be set when PEER_DISCOVERY=dns")
+		os.Exit(1)
+	}
+
+	cfg.GossipEnabled = os.Getenv("GOSSIP_ENABLED") == "true"
+	cfg.GossipPort, set = os.LookupEnv("GOSSIP_PORT")
+	if !set {
+		cfg.GossipPort = "7946"
+	}
+	gossipInterval, set := os.LookupEnv("GOSSIP_INTERVAL_MS")
+	if !set {
+		gossipInterval = "1000"
+	}
+	cfg.GossipIntervalMS, err = strconv.Atoi(gossipInterval)
+	if err != nil || cfg.GossipIntervalMS <= 0 {
+		log.Error("Invalid GOSSIP_INTERVAL_MS.  Must be a positive integer")
+		os.Exit(1)
+	}
+
+	cfg.ThroughputCron = os.Getenv("THROUGHPUT_CHECK_CRON")
+
+	throughputMB, set := os.LookupEnv("THROUGHPUT_MB")
+	if !set {
+		throughputMB = "50"
+	}
+	mb, err := strconv.Atoi(throughputMB)
+	if err != nil || mb <= 0 || mb > 1024 {
+		log.Error("Invalid THROUGHPUT_MB.  Must be an integer between 1 and 1024")
+		os.Exit(1)
+	}
+	cfg.ThroughputBytes = int64(mb) * 1000 * 1000
+
+	throughputSeconds, set := os.LookupEnv("THROUGHPUT_SECONDS")
+	if !set {
+		throughputSeconds = "10"
+	}
+	cfg.ThroughputSeconds, err = strconv.Atoi(throughputSeconds)
+	if err != nil || cfg.ThroughputSeconds <= 0 || cfg.ThroughputSeconds > 60 {
+		log.Error("Invalid THROUGHPUT_SECONDS.  Must be an integer between 1 and 60")
+		os.Exit(1)
+	}
+
+	cfg.ThroughputPort, set = os.LookupEnv("THROUGHPUT_PORT")
+	if !set {
+		cfg.ThroughputPort = "7779"
+	}
+
+	warnDays, set := os.LookupEnv("CERT_EXPIRY_WARN_DAYS")
+	if !set {
+		warnDays = "30,7,1"
+	}
+	for _, days := range strings.Split(warnDays, ",") {
+		days = strings.TrimSpace(days)
+		if days == "" {
+			continue
+		}
+		d, err := strconv.Atoi(days)
+		if err != nil {
+			log.Error("Invalid CERT_EXPIRY_WARN_DAYS.  Must be comma separated integers")
+			os.Exit(1)
+		}
+		cfg.CertExpiryWarnDays = append(cfg.CertExpiryWarnDays, d)
+	}
+
+	targetsFile, set := os.LookupEnv("TARGETS_FILE")
+	if !set {
+		targetsFile = "targets.json"
+	}
+	cfg.Targets, err = loadTargets(targetsFile)
+	if err != nil {
+		if !set && os.IsNotExist(err) {
+			log.Info("No targets.json found")
+		} else {
+			log.WithError(err).Error("Unable to load TARGETS_FILE")
+			os.Exit(1)
+		}
+	}
+
+	cfg.PrivateTLSCert = os.Getenv("PRIVATE_TLS_CERT")
+	cfg.PrivateTLSKey = os.Getenv("PRIVATE_TLS_KEY")
+	cfg.PrivateTLSCA = os.Getenv("PRIVATE_TLS_CA")
+	if cfg.PrivateTLSCert != "" || cfg.PrivateTLSKey != "" || cfg.PrivateTLSCA != "" {
+		if cfg.PrivateTLSCert == "" || cfg.PrivateTLSKey == "" || cfg.PrivateTLSCA == "" {
+			log.Error("PRIVATE_TLS_CERT, PRIVATE_TLS_KEY and PRIVATE_TLS_CA must all be set to enable private TLS")
+			os.Exit(1)
+		}
+		cfg.PrivateTLS = true
+	}
+	// DNS discovery yields bare IPs, which a certificate issued to dyno
+	// names can never match, so every private check would fail on identity.
+	if cfg.PrivateTLS && cfg.PeerDiscovery == "dns" {
+		log.Error("PEER_DISCOVERY=dns can't be combined with private TLS, since peers are addressed by IP")
+		os.Exit(1)
+	}
+
+	roles, set := os.LookupEnv("ROLE")
+	if !set || roles == "" {
+		roles = RoleWeb + "," + RoleProber
+	}
+	cfg.Roles = splitList(roles)
+	for _, role := range cfg.Roles {
+		if role != RoleWeb && role != RoleProber && role != RoleAggregator {
+			log.Error("Invalid ROLE.  Must be a comma separated list of web, prober and aggregator")
+			os.Exit(1)
+		}
+	}
+
+	cfg.AggregatorCron, set = os.LookupEnv("AGGREGATOR_CRON")
+	if !set {
+		cfg.AggregatorCron = "0 * * * * *"
+	}
+
+	historyLength, set := os.LookupEnv("HISTORY_LENGTH")
+	if !set {
+		historyLength = "1440"
+	}
+	cfg.HistoryLength, err = strconv.Atoi(historyLength)
+	if err != nil || cfg.HistoryLength <= 0 {
+		log.Error("Invalid HISTORY_LENGTH.  Must be a positive integer")
+		os.Exit(1)
+	}
+
+	sloTarget, set := os.LookupEnv("SLO_TARGET")
+	if !set {
+		sloTarget = "99"
+	}
+	cfg.SLOTarget, err = strconv.ParseFloat(sloTarget, 64)
+	if err != nil || cfg.SLOTarget <= 0 || cfg.SLOTarget > 100 {
+		log.Error("Invalid SLO_TARGET.  Must be a percentage between 0 and 100")
+		os.Exit(1)
+	}
+
+	alertAfter, set := os.LookupEnv("ALERT_AFTER")
+	if !set {
+		alertAfter = "3"
+	}
+	cfg.AlertAfter, err = strconv.Atoi(alertAfter)
+	if err != nil || cfg.AlertAfter <= 0 {
+		log.Error("Invalid ALERT_AFTER.  Must be a positive integer")
+		os.Exit(1)
+	}
+
+	cfg.AlertWebhookURL = os.Getenv("ALERT_WEBHOOK_URL")
+
+	cfg.NTPServer = os.Getenv("NTP_SERVER")
+
+	skewWarn, set := os.LookupEnv("CLOCK_SKEW_WARN_MS")
+	if !set {
+		skewWarn = "500"
+	}
+	cfg.ClockSkewWarnMS, err = strconv.Atoi(skewWarn)
+	if err != nil || cfg.ClockSkewWarnMS <= 0 {
+		log.Error("Invalid CLOCK_SKEW_WARN_MS.  Must be a positive integer")
+		os.Exit(1)
+	}
+
 	return cfg
 }
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func systemResolvers(path string) []string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.WithError(err).Info("Unable to read system resolvers")
+		return nil
+	}
+	var resolvers []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			resolvers = append(resolvers, fields[1])
+		}
+	}
+	return resolvers
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+const (
+	TargetHTTP   = "http"
+	TargetScript = "script"
+
+	ConnectionPooled = "pooled"
+	ConnectionFresh  = "fresh"
+	ConnectionBoth   = "both"
+)
+
+type Target struct {
+	Name    string            `json:"name"`
+	Type    string            `json:"type"`
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Assert  Assertions        `json:"assert"`
+	Steps   []Step            `json:"steps"`
+
+	// Connection is "pooled" (the default) to reuse keep-alive connections
+	// between checks, "fresh" to resolve and connect from scratch every
+	// check, or "both" to record each separately.
+	Connection string `json:"connection"`
+}
+
+// Step is one request of a script target.  Extract maps variable names to
+// "json:<path>", "header:<name>" or "regex:<pattern>" sources in the response,
+// and later steps refer to them as ${name} in their url, headers and body.
+type Step struct {
+	Name    string            `json:"name"`
+	URL     string            `json:"url"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	Extract map[string]string `json:"extract"`
+	Assert  Assertions        `json:"assert"`
+}
+
+// Assertions describe what a passing response looks like.  With no
+// assertions any 2xx response passes.
+type Assertions struct {
+	Status       []int                  `json:"status"`
+	Headers      map[string]string      `json:"headers"`
+	BodyContains string                 `json:"body_contains"`
+	BodyRegex    string                 `json:"body_regex"`
+	JSON         map[string]interface{} `json:"json"`
+	MaxBytes     int64                  `json:"max_bytes"`
+}
+
+func (t Target) ConnectionModes() []string {
+	switch t.Connection {
+	case ConnectionFresh:
+		return []string{ConnectionFresh}
+	case ConnectionBoth:
+		return []string{ConnectionPooled, ConnectionFresh}
+	default:
+		return []string{ConnectionPooled}
+	}
+}
+
+func (t Target) Dest() string {
+	if t.Name != "" {
+		return t.Name
+	}
+	return t.URL
+}
+
+type targetsFile struct {
+	Targets []Target `json:"targets"`
+}
+
+func loadTargets(path string) ([]Target, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file targetsFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %v: %w", path, err)
+	}
+	for i, target := range file.Targets {
+		switch target.Connection {
+		case "", ConnectionPooled, ConnectionFresh, ConnectionBoth:
+		default:
+			return nil, fmt.Errorf("target %v in %v has unknown connection mode %q", i, path, target.Connection)
+		}
+		switch target.Type {
+		case "", TargetHTTP:
+			if target.URL == "" {
+				return nil, fmt.Errorf("target %v in %v has no url", i, path)
+			}
+		case TargetScript:
+			if target.Name == "" || len(target.Steps) == 0 {
+				return nil, fmt.Errorf("script target %v in %v needs a name and steps", i, path)
+			}
+			for j, step := range target.Steps {
+				if step.URL == "" {
+					return nil, fmt.Errorf("step %v of target %v in %v has no url", j, target.Name, path)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("target %v in %v has unknown type %q", i, path, target.Type)
+		}
+	}
+	return file.Targets, nil
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func writeTargets(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "targets.json")
+	err := os.WriteFile(path, []byte(contents), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadTargetsAssertions(t *testing.T) {
+	path := writeTargets(t, `{"targets": [
+		{"name": "api", "url": "https://api.example.com/health", "assert": {
+			"status": [200, 204],
+			"headers": {"Content-Type": "application/json", "X-Request-Id": ""},
+			"body_contains": "ok",
+			"body_regex": "^\\{",
+			"json": {"status": "up", "checks.0.healthy": true, "version": 3},
+			"max_bytes": 4096
+		}},
+		{"name": "login", "type": "script", "steps": [
+			{"url": "https://api.example.com/login", "method": "POST", "assert": {"status": [201]}}
+		]}
+	]}`)
+	targets, err := loadTargets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("got %v targets, want 2", len(targets))
+	}
+
+	want := Assertions{
+		Status:       []int{200, 204},
+		Headers:      map[string]string{"Content-Type": "application/json", "X-Request-Id": ""},
+		BodyContains: "ok",
+		BodyRegex:    `^\{`,
+		// JSON numbers decode as float64, which is what checkBody compares
+		// the response's values against.
+		JSON:     map[string]interface{}{"status": "up", "checks.0.healthy": true, "version": float64(3)},
+		MaxBytes: 4096,
+	}
+	if got := targets[0].Assert; !reflect.DeepEqual(got, want) {
+		t.Errorf("assertions = %+v, want %+v", got, want)
+	}
+	if got := targets[1].Steps[0].Assert.Status; !reflect.DeepEqual(got, []int{201}) {
+		t.Errorf("step status = %v, want [201]", got)
+	}
+	if got := targets[0].Dest(); got != "api" {
+		t.Errorf("dest = %v, want api", got)
+	}
+}
+
+func TestLoadTargetsErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+	}{
+		{name: "malformed", contents: `{"targets": [`},
+		{name: "status not a list", contents: `{"targets": [{"url": "https://a", "assert": {"status": 200}}]}`},
+		{name: "status not a number", contents: `{"targets": [{"url": "https://a", "assert": {"status": ["2xx"]}}]}`},
+		{name: "max_bytes not a number", contents: `{"targets": [{"url": "https://a", "assert": {"max_bytes": "1k"}}]}`},
+		{name: "header value not a string", contents: `{"targets": [{"url": "https://a", "assert": {"headers": {"X": 1}}}]}`},
+		{name: "no url", contents: `{"targets": [{"name": "a"}]}`},
+		{name: "unknown type", contents: `{"targets": [{"url": "https://a", "type": "grpc"}]}`},
+		{name: "unknown connection", contents: `{"targets": [{"url": "https://a", "connection": "sticky"}]}`},
+		{name: "script without steps", contents: `{"targets": [{"name": "a", "type": "script"}]}`},
+		{name: "script step without url", contents: `{"targets": [{"name": "a", "type": "script", "steps": [{"method": "GET"}]}]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targets, err := loadTargets(writeTargets(t, tt.contents))
+			if err == nil {
+				t.Errorf("got %+v, want an error", targets)
+			}
+		})
+	}
+
+	_, err := loadTargets(filepath.Join(t.TempDir(), "missing.json"))
+	if err == nil {
+		t.Error("missing file loaded without an error")
+	}
+}
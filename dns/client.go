@@ -0,0 +1,242 @@
+package dns
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	TypeA     uint16 = 1
+	TypeCNAME uint16 = 5
+	TypeAAAA  uint16 = 28
+
+	classIN uint16 = 1
+)
+
+var rcodeNames = map[int]string{
+	1: "FORMERR",
+	2: "SERVFAIL",
+	3: "NXDOMAIN",
+	4: "NOTIMP",
+	5: "REFUSED",
+}
+
+type RcodeError struct {
+	Rcode int
+}
+
+func (e *RcodeError) Error() string {
+	if name, ok := rcodeNames[e.Rcode]; ok {
+		return name
+	}
+	return fmt.Sprintf("rcode %v", e.Rcode)
+}
+
+type Answer struct {
+	Name  string
+	Type  uint16
+	TTL   uint32
+	Value string
+}
+
+// Query sends a single recursive question for name straight to server over
+// network ("udp" or "tcp"), bypassing the OS stub resolver and any caching.
+func Query(ctx context.Context, server string, network string, name string, qtype uint16) ([]Answer, error) {
+	var idBytes [2]byte
+	_, err := rand.Read(idBytes[:])
+	if err != nil {
+		return nil, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+	msg, err := buildQuery(id, name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	var resp []byte
+	switch network {
+	case "udp":
+		_, err = conn.Write(msg)
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			// Ignore stray datagrams that aren't replies to our question.
+			if n >= 2 && binary.BigEndian.Uint16(buf) == id {
+				resp = buf[:n]
+				break
+			}
+		}
+	case "tcp":
+		framed := make([]byte, 2+len(msg))
+		binary.BigEndian.PutUint16(framed, uint16(len(msg)))
+		copy(framed[2:], msg)
+		_, err = conn.Write(framed)
+		if err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		_, err = io.ReadFull(conn, length[:])
+		if err != nil {
+			return nil, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(length[:]))
+		_, err = io.ReadFull(conn, resp)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported network %q", network)
+	}
+
+	return parseResponse(id, resp)
+}
+
+func buildQuery(id uint16, name string, qtype uint16) ([]byte, error) {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)      // QDCOUNT
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(msg[len(msg)-4:], qtype)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], classIN)
+	return msg, nil
+}
+
+var errTruncated = errors.New("truncated DNS message")
+
+func parseResponse(id uint16, msg []byte) ([]Answer, error) {
+	if len(msg) < 12 {
+		return nil, errTruncated
+	}
+	if binary.BigEndian.Uint16(msg) != id {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 == 0 {
+		return nil, errors.New("DNS message is not a response")
+	}
+	if flags&0x0200 != 0 {
+		return nil, errors.New("DNS response truncated")
+	}
+	if rcode := int(flags & 0x000f); rcode != 0 {
+		return nil, &RcodeError{Rcode: rcode}
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+
+	offset := 12
+	for i := 0; i < qdcount; i++ {
+		_, next, err := readName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next + 4
+	}
+
+	answers := make([]Answer, 0, ancount)
+	for i := 0; i < ancount; i++ {
+		name, next, err := readName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = next
+		if offset+10 > len(msg) {
+			return nil, errTruncated
+		}
+		rtype := binary.BigEndian.Uint16(msg[offset:])
+		ttl := binary.BigEndian.Uint32(msg[offset+4:])
+		rdlength := int(binary.BigEndian.Uint16(msg[offset+8:]))
+		offset += 10
+		if offset+rdlength > len(msg) {
+			return nil, errTruncated
+		}
+		rdata := msg[offset : offset+rdlength]
+
+		answer := Answer{Name: name, Type: rtype, TTL: ttl}
+		switch rtype {
+		case TypeA, TypeAAAA:
+			answer.Value = net.IP(rdata).String()
+		case TypeCNAME:
+			answer.Value, _, err = readName(msg, offset)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			offset += rdlength
+			continue
+		}
+		answers = append(answers, answer)
+		offset += rdlength
+	}
+	return answers, nil
+}
+
+// readName decodes a possibly compressed name at offset and returns the
+// offset just past it in the original message.
+func readName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errTruncated
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, errTruncated
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			jumps++
+			if jumps > 10 {
+				return "", 0, errors.New("DNS name compression loop")
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errTruncated
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package dns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testServer answers A queries from records and NXDOMAIN for anything else,
+// over both UDP and TCP.
+type testServer struct {
+	records map[string][]string
+	udp     net.PacketConn
+	tcp     net.Listener
+}
+
+func newTestServer(t *testing.T, records map[string][]string) *testServer {
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{records: records, udp: udp, tcp: tcp}
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, peer, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			udp.WriteTo(s.answer(buf[:n]), peer)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var length [2]byte
+				if _, err := io.ReadFull(conn, length[:]); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length[:]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := s.answer(query)
+				binary.BigEndian.PutUint16(length[:], uint16(len(resp)))
+				conn.Write(append(length[:], resp...))
+			}()
+		}
+	}()
+	return s
+}
+
+func (s *testServer) addr(network string) string {
+	if network == "tcp" {
+		return s.tcp.Addr().String()
+	}
+	return s.udp.LocalAddr().String()
+}
+
+func (s *testServer) answer(query []byte) []byte {
+	name, end, err := readName(query, 12)
+	if err != nil {
+		return nil
+	}
+	question := query[12 : end+4]
+
+	resp := make([]byte, 12, 512)
+	copy(resp, query[:2])
+	flags := uint16(0x8180) // QR, RD, RA
+	addrs, ok := s.records[name]
+	if !ok {
+		flags |= 3 // NXDOMAIN
+	}
+	binary.BigEndian.PutUint16(resp[2:], flags)
+	binary.BigEndian.PutUint16(resp[4:], 1)
+	binary.BigEndian.PutUint16(resp[6:], uint16(len(addrs)))
+	resp = append(resp, question...)
+	for _, addr := range addrs {
+		// Point back at the question's name to exercise compression.
+		rr := []byte{0xc0, 12, 0, byte(TypeA), 0, byte(classIN), 0, 0, 0, 60, 0, 4}
+		resp = append(resp, rr...)
+		resp = append(resp, net.ParseIP(addr).To4()...)
+	}
+	return resp
+}
+
+func TestQuery(t *testing.T) {
+	server := newTestServer(t, map[string][]string{
+		"web.1.app.app.localspace.": {"10.0.1.5"},
+		"multi.example.com.":        {"10.0.0.1", "10.0.0.2"},
+	})
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			answers, err := Query(ctx, server.addr(network), network, "multi.example.com", TypeA)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			var got []string
+			for _, answer := range answers {
+				if answer.Name != "multi.example.com." || answer.Type != TypeA || answer.TTL != 60 {
+					t.Errorf("unexpected answer %+v", answer)
+				}
+				got = append(got, answer.Value)
+			}
+			if want := []string{"10.0.0.1", "10.0.0.2"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+
+			_, err = Query(ctx, server.addr(network), network, "missing.example.com", TypeA)
+			var rcodeErr *RcodeError
+			if !errors.As(err, &rcodeErr) || rcodeErr.Error() != "NXDOMAIN" {
+				t.Errorf("err = %v, want NXDOMAIN", err)
+			}
+		})
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	// A socket that never answers.
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = Query(ctx, silent.LocalAddr().String(), "udp", "example.com", TypeA)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("err = %v, want a timeout", err)
+	}
+}
+
+func TestParseResponseRejectsMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"short":        {0, 1, 0x81},
+		"not response": {0, 1, 0x01, 0x00, 0, 0, 0, 0, 0, 0, 0, 0},
+		"wrong id":     {0, 2, 0x81, 0x80, 0, 0, 0, 0, 0, 0, 0, 0},
+		"loop":         {0, 1, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 0xc0, 12},
+	}
+	for name, msg := range tests {
+		_, err := parseResponse(1, msg)
+		if err == nil {
+			t.Errorf("%v: parsed without error", name)
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package gossip
+
+import (
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	indirectProbes = 3
+	maxPiggyback   = 40
+	maxPacketSize  = 65507
+	// maxMessageSize keeps outgoing messages to a single unfragmented
+	// packet; membership and results are sampled down to fit.
+	maxMessageSize = 1400
+)
+
+type State int
+
+const (
+	Alive State = iota
+	Suspect
+	Dead
+)
+
+func (s State) String() string {
+	switch s {
+	case Alive:
+		return "alive"
+	case Suspect:
+		return "suspect"
+	default:
+		return "dead"
+	}
+}
+
+type Member struct {
+	ID          string
+	Addr        string
+	State       State
+	Incarnation uint64
+	// Updated is when this node last saw the member's state change.
+	Updated time.Time
+}
+
+// Result is a check result as recorded by its source dyno.  Newer results
+// replace older ones for the same source and key.
+type Result struct {
+	Source string
+	Key    string
+	Value  string
+	Time   time.Time
+}
+
+type Config struct {
+	ID            string
+	BindAddr      string
+	AdvertiseAddr string
+	Interval      time.Duration
+}
+
+type memberUpdate struct {
+	ID          string
+	Addr        string
+	State       State
+	Incarnation uint64
+}
+
+type message struct {
+	Type     string
+	Seq      uint64
+	From     string
+	FromAddr string
+	Target   string
+	Members  []memberUpdate
+	Results  []Result
+}
+
+// Node keeps SWIM-style membership of its peers over UDP: each interval it
+// pings one member directly, falls back to asking others to ping it
+// indirectly, and suspects then declares it dead if nobody can reach it.
+// Membership changes and check results piggyback on every message, so each
+// node converges on the same view without any shared store.
+type Node struct {
+	cfg  Config
+	conn net.PacketConn
+
+	mu          sync.Mutex
+	incarnation uint64
+	members     map[string]*Member
+	results     map[string]map[string]Result
+	acks        map[uint64]chan struct{}
+	seq         uint64
+	probeOrder  []string
+}
+
+func New(cfg Config) (*Node, error) {
+	conn, err := net.ListenPacket("udp", cfg.BindAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &Node{
+		cfg:     cfg,
+		conn:    conn,
+		members: make(map[string]*Member),
+		results: make(map[string]map[string]Result),
+		acks:    make(map[uint64]chan struct{}),
+	}, nil
+}
+
+func (n *Node) Start() {
+	go n.listen()
+	go n.probeLoop()
+}
+
+// Join pings each address so that the peers behind them learn about this
+// node and reply with what they know.
+func (n *Node) Join(addrs []string) {
+	for _, addr := range addrs {
+		if addr == n.cfg.AdvertiseAddr {
+			continue
+		}
+		n.send(addr, n.newMessage("ping", n.nextSeq(), ""))
+	}
+}
+
+func (n *Node) SetResult(key string, value string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.setResult(Result{Source: n.cfg.ID, Key: key, Value: value, Time: time.Now()})
+}
+
+// Members returns every known peer, not including this node.
+func (n *Node) Members() []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	members := make([]Member, 0, len(n.members))
+	for _, m := range n.members {
+		members = append(members, *m)
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+	return members
+}
+
+// Results returns the latest results by source dyno and key.
+func (n *Node) Results() map[string]map[string]Result {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	results := make(map[string]map[string]Result, len(n.results))
+	for source, byKey := range n.results {
+		results[source] = make(map[string]Result, len(byKey))
+		for key, result := range byKey {
+			results[source][key] = result
+		}
+	}
+	return results
+}
+
+func (n *Node) ID() string {
+	return n.cfg.ID
+}
+
+func (n *Node) listen() {
+	buf := make([]byte, maxPacketSize)
+	for {
+		size, from, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			log.WithError(err).Error("Gossip listener stopped")
+			return
+		}
+		var msg message
+		err = json.Unmarshal(buf[:size], &msg)
+		if err != nil {
+			log.WithError(err).WithField("from", from.String()).Warn("Invalid gossip message")
+			continue
+		}
+		n.handle(msg)
+	}
+}
+
+func (n *Node) handle(msg message) {
+	n.mu.Lock()
+	if msg.From != "" && msg.From != n.cfg.ID {
+		if _, known := n.members[msg.From]; !known {
+			n.mergeMember(memberUpdate{ID: msg.From, Addr: msg.FromAddr, State: Alive})
+		}
+	}
+	for _, update := range msg.Members {
+		n.mergeMember(update)
+	}
+	for _, result := range msg.Results {
+		// Results from members we've declared dead or forgotten would
+		// otherwise be revived by peers that haven't caught up yet.
+		if m, ok := n.members[result.Source]; ok && m.State != Dead {
+			n.setResult(result)
+		}
+	}
+	n.mu.Unlock()
+
+	switch msg.Type {
+	case "ping":
+		n.send(msg.FromAddr, n.newMessage("ack", msg.Seq, ""))
+	case "ping-req":
+		go n.indirectPing(msg)
+	case "ack":
+		n.mu.Lock()
+		ch, ok := n.acks[msg.Seq]
+		if ok {
+			delete(n.acks, msg.Seq)
+			close(ch)
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) indirectPing(req message) {
+	seq := n.nextSeq()
+	ack := n.expectAck(seq)
+	n.send(req.Target, n.newMessage("ping", seq, ""))
+	select {
+	case <-ack:
+		n.send(req.FromAddr, n.newMessage("ack", req.Seq, ""))
+	case <-time.After(n.cfg.Interval):
+		n.dropAck(seq)
+	}
+}
+
+func (n *Node) probeLoop() {
+	ticker := time.NewTicker(n.cfg.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		n.reapSuspects()
+		target, ok := n.nextProbeTarget()
+		if !ok {
+			continue
+		}
+		n.probe(target)
+	}
+}
+
+func (n *Node) probe(target Member) {
+	seq := n.nextSeq()
+	ack := n.expectAck(seq)
+	defer n.dropAck(seq)
+
+	n.send(target.Addr, n.newMessage("ping", seq, ""))
+	select {
+	case <-ack:
+		return
+	case <-time.After(n.cfg.Interval / 3):
+	}
+
+	for _, helper := range n.randomMembers(indirectProbes, target.ID) {
+		n.send(helper.Addr, n.newMessage("ping-req", seq, target.Addr))
+	}
+	select {
+	case <-ack:
+		return
+	case <-time.After(n.cfg.Interval / 2):
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if m, ok := n.members[target.ID]; ok && m.State == Alive && m.Incarnation == target.Incarnation {
+		m.State = Suspect
+		m.Updated = time.Now()
+		log.WithField("member", m.ID).Warn("Gossip member suspected")
+	}
+}
+
+// reapSuspects declares members dead once they've been suspected for long
+// enough to have refuted it, and forgets members that have been dead a while.
+func (n *Node) reapSuspects() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	now := time.Now()
+	for id, m := range n.members {
+		switch {
+		case m.State == Suspect && now.Sub(m.Updated) > 5*n.cfg.Interval:
+			m.State = Dead
+			m.Updated = now
+			log.WithField("member", id).Warn("Gossip member dead")
+		case m.State == Dead && now.Sub(m.Updated) > 300*n.cfg.Interval:
+			delete(n.members, id)
+			delete(n.results, id)
+		}
+	}
+}
+
+func (n *Node) nextProbeTarget() (Member, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for attempts := 0; attempts < 2; attempts++ {
+		for len(n.probeOrder) > 0 {
+			id := n.probeOrder[0]
+			n.probeOrder = n.probeOrder[1:]
+			if m, ok := n.members[id]; ok && m.State != Dead {
+				return *m, true
+			}
+		}
+		for id := range n.members {
+			n.probeOrder = append(n.probeOrder, id)
+		}
+		rand.Shuffle(len(n.probeOrder), func(i, j int) {
+			n.probeOrder[i], n.probeOrder[j] = n.probeOrder[j], n.probeOrder[i]
+		})
+	}
+	return Member{}, false
+}
+
+func (n *Node) randomMembers(count int, exclude string) []Member {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var candidates []Member
+	for id, m := range n.members {
+		if id != exclude && m.State == Alive {
+			candidates = append(candidates, *m)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > count {
+		candidates = candidates[:count]
+	}
+	return candidates
+}
+
+// mergeMember applies SWIM's precedence rules: a higher incarnation always
+// wins, and at the same incarnation suspect beats alive and dead beats both.
+// Must be called with n.mu held.
+func (n *Node) mergeMember(update memberUpdate) {
+	if update.ID == n.cfg.ID {
+		if update.State != Alive && update.Incarnation >= n.incarnation {
+			n.incarnation = update.Incarnation + 1
+			log.WithField("incarnation", n.incarnation).Info("Refuting gossip suspicion")
+		}
+		return
+	}
+	m, ok := n.members[update.ID]
+	if !ok {
+		if update.State == Dead {
+			return
+		}
+		n.members[update.ID] = &Member{
+			ID:          update.ID,
+			Addr:        update.Addr,
+			State:       update.State,
+			Incarnation: update.Incarnation,
+			Updated:     time.Now(),
+		}
+		log.WithField("member", update.ID).Info("Gossip member joined")
+		return
+	}
+	if update.Incarnation > m.Incarnation || (update.Incarnation == m.Incarnation && update.State > m.State) {
+		if update.State != m.State {
+			m.Updated = time.Now()
+		}
+		m.State = update.State
+		m.Incarnation = update.Incarnation
+		if update.Addr != "" {
+			m.Addr = update.Addr
+		}
+	}
+}
+
+// Must be called with n.mu held.
+func (n *Node) setResult(result Result) {
+	byKey, ok := n.results[result.Source]
+	if !ok {
+		byKey = make(map[string]Result)
+		n.results[result.Source] = byKey
+	}
+	if existing, ok := byKey[result.Key]; ok && !result.Time.After(existing.Time) {
+		return
+	}
+	byKey[result.Key] = result
+}
+
+func (n *Node) newMessage(msgType string, seq uint64, target string) message {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	msg := message{
+		Type:     msgType,
+		Seq:      seq,
+		From:     n.cfg.ID,
+		FromAddr: n.cfg.AdvertiseAddr,
+		Target:   target,
+		Members: []memberUpdate{{
+			ID:          n.cfg.ID,
+			Addr:        n.cfg.AdvertiseAddr,
+			State:       Alive,
+			Incarnation: n.incarnation,
+		}},
+	}
+	for _, m := range n.members {
+		msg.Members = append(msg.Members, memberUpdate{ID: m.ID, Addr: m.Addr, State: m.State, Incarnation: m.Incarnation})
+	}
+	others := msg.Members[1:]
+	rand.Shuffle(len(others), func(i, j int) { others[i], others[j] = others[j], others[i] })
+
+	// A random sample keeps messages small while still spreading every
+	// result eventually.  A dead member's results stay out, since they only
+	// describe a dyno that's gone.
+	var results []Result
+	for source, byKey := range n.results {
+		if m, ok := n.members[source]; source != n.cfg.ID && (!ok || m.State == Dead) {
+			continue
+		}
+		for _, result := range byKey {
+			results = append(results, result)
+		}
+	}
+	rand.Shuffle(len(results), func(i, j int) { results[i], results[j] = results[j], results[i] })
+	if len(results) > maxPiggyback {
+		results = results[:maxPiggyback]
+	}
+	msg.Results = results
+	return msg
+}
+
+// encode marshals msg, dropping piggybacked results and then members (never
+// the sender itself) until it fits in maxMessageSize.  Both are shuffled, so
+// what's dropped differs from message to message and still spreads.
+func encode(msg message) ([]byte, error) {
+	for {
+		data, err := json.Marshal(msg)
+		if err != nil || len(data) <= maxMessageSize {
+			return data, err
+		}
+		switch {
+		case len(msg.Results) > 0:
+			msg.Results = msg.Results[:len(msg.Results)/2]
+		case len(msg.Members) > 1:
+			msg.Members = msg.Members[:(len(msg.Members)+1)/2]
+		default:
+			return data, nil
+		}
+	}
+}
+
+func (n *Node) send(addr string, msg message) {
+	if addr == "" {
+		return
+	}
+	data, err := encode(msg)
+	if err != nil {
+		log.WithError(err).Error("Unable to encode gossip message")
+		return
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		log.WithError(err).WithField("addr", addr).Warn("Unable to resolve gossip peer")
+		return
+	}
+	_, err = n.conn.WriteTo(data, udpAddr)
+	if err != nil {
+		log.WithError(err).WithField("addr", addr).Warn("Unable to send gossip message")
+	}
+}
+
+func (n *Node) nextSeq() uint64 {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.seq++
+	return n.seq
+}
+
+func (n *Node) expectAck(seq uint64) chan struct{} {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	ch := make(chan struct{})
+	n.acks[seq] = ch
+	return ch
+}
+
+func (n *Node) dropAck(seq uint64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.acks, seq)
+}
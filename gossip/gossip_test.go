@@ -0,0 +1,152 @@
+package gossip
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestNode(t *testing.T, id string) *Node {
+	n, err := New(Config{ID: id, BindAddr: "127.0.0.1:0", Interval: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.cfg.AdvertiseAddr = n.conn.LocalAddr().String()
+	t.Cleanup(func() { n.conn.Close() })
+	return n
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func memberState(n *Node, id string) (State, bool) {
+	for _, m := range n.Members() {
+		if m.ID == id {
+			return m.State, true
+		}
+	}
+	return Dead, false
+}
+
+func TestMembershipAndResultsConverge(t *testing.T) {
+	a, b, c := newTestNode(t, "web.1"), newTestNode(t, "web.2"), newTestNode(t, "web.3")
+	for _, n := range []*Node{a, b, c} {
+		n.Start()
+	}
+	// c only knows about b, and has to learn about a through it.
+	a.Join([]string{b.cfg.AdvertiseAddr})
+	c.Join([]string{b.cfg.AdvertiseAddr})
+
+	waitFor(t, "membership", func() bool {
+		return len(a.Members()) == 2 && len(b.Members()) == 2 && len(c.Members()) == 2
+	})
+	c.SetResult("udp|web.2", "pass:ok")
+	waitFor(t, "result to reach a", func() bool {
+		return a.Results()["web.3"]["udp|web.2"].Value == "pass:ok"
+	})
+}
+
+func TestUnreachableMemberIsDeclaredDead(t *testing.T) {
+	a, b := newTestNode(t, "web.1"), newTestNode(t, "web.2")
+	a.Start()
+	b.Start()
+	a.Join([]string{b.cfg.AdvertiseAddr})
+	waitFor(t, "a to know b", func() bool {
+		state, ok := memberState(a, "web.2")
+		return ok && state == Alive
+	})
+
+	b.conn.Close()
+	waitFor(t, "b to be declared dead", func() bool {
+		state, _ := memberState(a, "web.2")
+		return state == Dead
+	})
+}
+
+func TestMergeMemberPrecedence(t *testing.T) {
+	n := newTestNode(t, "web.1")
+	n.mergeMember(memberUpdate{ID: "web.2", Addr: "a", State: Alive, Incarnation: 1})
+
+	n.mergeMember(memberUpdate{ID: "web.2", State: Suspect, Incarnation: 0})
+	if state, _ := memberState(n, "web.2"); state != Alive {
+		t.Errorf("stale suspicion applied: %v", state)
+	}
+	n.mergeMember(memberUpdate{ID: "web.2", State: Suspect, Incarnation: 1})
+	if state, _ := memberState(n, "web.2"); state != Suspect {
+		t.Errorf("suspicion at same incarnation ignored: %v", state)
+	}
+	n.mergeMember(memberUpdate{ID: "web.2", State: Alive, Incarnation: 1})
+	if state, _ := memberState(n, "web.2"); state != Suspect {
+		t.Errorf("alive at same incarnation overrode suspicion: %v", state)
+	}
+	n.mergeMember(memberUpdate{ID: "web.2", State: Alive, Incarnation: 2})
+	if state, _ := memberState(n, "web.2"); state != Alive {
+		t.Errorf("refutation ignored: %v", state)
+	}
+
+	n.mergeMember(memberUpdate{ID: "web.1", State: Suspect, Incarnation: 0})
+	if n.incarnation != 1 {
+		t.Errorf("suspicion of self not refuted, incarnation %v", n.incarnation)
+	}
+}
+
+func TestForgottenMemberResultsDropped(t *testing.T) {
+	n := newTestNode(t, "web.1")
+	n.mergeMember(memberUpdate{ID: "web.2", Addr: "a", State: Alive})
+	n.handle(message{Type: "ack", Results: []Result{{Source: "web.2", Key: "udp|x", Value: "pass", Time: time.Now()}}})
+	if len(n.Results()["web.2"]) != 1 {
+		t.Fatalf("result from live member not kept")
+	}
+
+	n.mu.Lock()
+	n.members["web.2"].State = Dead
+	n.mu.Unlock()
+	if msg := n.newMessage("ping", 1, ""); len(msg.Results) != 0 {
+		t.Errorf("dead member's results piggybacked: %v", msg.Results)
+	}
+
+	n.mu.Lock()
+	n.members["web.2"].Updated = time.Now().Add(-time.Hour)
+	n.mu.Unlock()
+	n.reapSuspects()
+	if _, ok := n.Results()["web.2"]; ok {
+		t.Errorf("forgotten member's results kept")
+	}
+
+	// A peer that hasn't caught up can't bring them back.
+	n.handle(message{Type: "ack", Results: []Result{{Source: "web.2", Key: "udp|x", Value: "pass", Time: time.Now()}}})
+	if _, ok := n.Results()["web.2"]; ok {
+		t.Errorf("forgotten member's results revived")
+	}
+}
+
+func TestMessagesFitOnePacket(t *testing.T) {
+	n := newTestNode(t, "web.1")
+	for i := 0; i < 200; i++ {
+		id := fmt.Sprintf("web.%v", i+2)
+		n.mergeMember(memberUpdate{ID: id, Addr: fmt.Sprintf("10.0.0.%v:7946", i), State: Alive})
+		n.results[id] = map[string]Result{
+			"private|x": {Source: id, Key: "private|x", Value: strings.Repeat("pass", 20), Time: time.Now()},
+		}
+	}
+
+	msg := n.newMessage("ping", 1, "")
+	data, err := encode(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > maxMessageSize {
+		t.Errorf("message is %v bytes, want at most %v", len(data), maxMessageSize)
+	}
+	if !strings.Contains(string(data), `"ID":"web.1"`) {
+		t.Errorf("sender dropped from its own message")
+	}
+}
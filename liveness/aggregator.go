@@ -0,0 +1,418 @@
+package liveness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	redisclient "github.com/archa347/ps-network-test/redis"
+	"github.com/carlmjohnson/requests"
+	"github.com/go-redis/redis/v8"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+var sloWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+type SLORollup struct {
+	Dyno    string
+	Type    string
+	Dest    string
+	Windows []SLOWindow
+}
+
+type SLOWindow struct {
+	Window       string
+	Samples      int
+	Failed       int
+	Availability float64
+	Met          bool
+}
+
+func (r SLORollup) Met() bool {
+	for _, window := range r.Windows {
+		if !window.Met {
+			return false
+		}
+	}
+	return true
+}
+
+// Aggregator samples every dyno's results into history, rolls the history up
+// into availability against the SLO target and alerts on failures.  It's
+// meant to run on one dyno; a lock in redis keeps a second one idle.
+type Aggregator struct {
+	checker       *Checker
+	redis         redisclient.Store
+	keys          keyspace
+	dyno          string
+	cron          string
+	historyLength int
+	sloTarget     float64
+	alertAfter    int
+	webhookURL    string
+}
+
+func NewAggregator(cfg config.Config, client redisclient.Store, checker *Checker) *Aggregator {
+	return &Aggregator{
+		checker:       checker,
+		redis:         client,
+		keys:          keyspace(cfg.Namespace),
+		dyno:          cfg.DynoID,
+		cron:          cfg.AggregatorCron,
+		historyLength: cfg.HistoryLength,
+		sloTarget:     cfg.SLOTarget,
+		alertAfter:    cfg.AlertAfter,
+		webhookURL:    cfg.AlertWebhookURL,
+	}
+}
+
+func (a *Aggregator) Start() {
+	crn := cron.New(cron.WithSeconds())
+	_, err := crn.AddFunc(a.cron, func() { a.Aggregate(context.Background()) })
+	if err != nil {
+		log.WithError(err).Error("Unable to start aggregator cron")
+	}
+	crn.Start()
+}
+
+// renewLock only extends the lock if we still hold it, so a lock that expired
+// between the SETNX and the renewal isn't extended for the dyno that took it.
+var renewLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// alertWebhookTimeout bounds each webhook call so a hung endpoint can't stall
+// the aggregator past its next run.
+const alertWebhookTimeout = 10 * time.Second
+
+// lock takes or renews the aggregator lock, reporting whether this dyno
+// holds it.
+func (a *Aggregator) lock(ctx context.Context) (bool, error) {
+	ttl := 5 * time.Minute
+	locked, err := a.redis.SetNX(ctx, a.keys.aggregatorLockKey(), a.dyno, ttl).Result()
+	if err != nil || locked {
+		return locked, err
+	}
+	renewed, err := renewLock.Run(ctx, a.redis, []string{a.keys.aggregatorLockKey()}, a.dyno, ttl.Milliseconds()).Int()
+	return renewed == 1, err
+}
+
+type historyEntry struct {
+	dyno       string
+	resultType string
+	dest       string
+	cmd        *redis.StringSliceCmd
+}
+
+func (h historyEntry) id() string {
+	return h.dyno + " " + resultsIndexMember(h.resultType, h.dest)
+}
+
+func (a *Aggregator) Aggregate(ctx context.Context) {
+	logger := log.WithField("fn", "Aggregator.Aggregate")
+	locked, err := a.lock(ctx)
+	if err != nil {
+		logger.WithError(err).Error("Unable to take aggregator lock")
+		return
+	}
+	if !locked {
+		logger.Info("Another dyno is aggregating")
+		return
+	}
+
+	now := time.Now()
+	reports := a.checker.dynoReports(ctx, a.keys, a.checker.getDynos(ctx, a.keys))
+
+	pipe := a.redis.Pipeline()
+	var entries []historyEntry
+	for _, report := range reports {
+		for _, category := range report.Categories() {
+			for _, check := range category.Checks {
+				key := a.keys.historyKey(report.Dyno, resultsIndexMember(category.Name, check.Dest))
+				sample := HistorySample{Time: now, State: check.State(), Value: sampleValue(category.Name, check.Result)}
+				pipe.LPush(ctx, key, sample.String())
+				pipe.LTrim(ctx, key, 0, int64(a.historyLength-1))
+				pipe.Expire(ctx, key, 48*time.Hour)
+				entries = append(entries, historyEntry{
+					dyno:       report.Dyno,
+					resultType: category.Name,
+					dest:       check.Dest,
+					cmd:        pipe.LRange(ctx, key, 0, -1),
+				})
+			}
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		logger.WithError(err).Error("Unable to record history")
+		return
+	}
+
+	rollups := make(map[string]interface{})
+	firing := make(map[string]string)
+	for _, entry := range entries {
+		var samples []HistorySample
+		for _, value := range entry.cmd.Val() {
+			if sample, ok := parseSample(value); ok {
+				samples = append(samples, sample)
+			}
+		}
+		rollup := a.rollup(entry, samples, now)
+		encoded, _ := json.Marshal(rollup)
+		rollups[entry.id()] = string(encoded)
+
+		if failing := leadingFailures(samples); failing >= a.alertAfter {
+			firing["failing "+entry.id()] = fmt.Sprintf("%v has failed %v times in a row: %v", describe(entry), failing, latestResult(reports, entry))
+		}
+		if !rollup.Met() {
+			firing["slo "+entry.id()] = fmt.Sprintf("%v is below its %v%% SLO: %v", describe(entry), a.sloTarget, describeWindows(rollup))
+		}
+	}
+
+	pipe = a.redis.TxPipeline()
+	pipe.Del(ctx, a.keys.sloKey())
+	if len(rollups) > 0 {
+		pipe.HSet(ctx, a.keys.sloKey(), rollups)
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		logger.WithError(err).Error("Unable to record SLO rollups")
+	}
+
+	for dyno, message := range a.silentDynos(ctx, reports, now) {
+		firing["silent "+dyno] = message
+	}
+	for _, report := range reports {
+		if report.Clock != nil && report.Clock.Skewed {
+			firing["skew "+report.Dyno] = fmt.Sprintf("%v's clock is off by %v from redis%v",
+				report.Dyno, report.Clock.Redis, ntpSkew(report.Clock))
+		}
+	}
+
+	a.alert(ctx, firing)
+}
+
+// silentDynos finds dynos that are still heartbeating, and so are still in
+// the report, but whose checks have stopped storing results, e.g. because
+// the checker's cron died.  Dynos that have never stored a result, like web
+// dynos that don't run checks, aren't expected to.
+func (a *Aggregator) silentDynos(ctx context.Context, reports []Report, now time.Time) map[string]string {
+	silent := make(map[string]string)
+	limit := a.checker.producerStaleAfter()
+	if limit == 0 {
+		return silent
+	}
+
+	pipe := a.redis.Pipeline()
+	last := make([]*redis.StringCmd, len(reports))
+	for i, report := range reports {
+		last[i] = pipe.Get(ctx, a.keys.lastResultKey(report.Dyno))
+	}
+	reference := pipe.Time(ctx)
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		log.WithError(err).Error("Unable to read last result times")
+		return silent
+	}
+
+	// Like the report, compare on redis's clock with each dyno's time moved
+	// onto it.
+	if t, err := reference.Result(); err == nil {
+		now = t
+	}
+	for i, report := range reports {
+		t, err := time.Parse(time.RFC3339, last[i].Val())
+		if err != nil {
+			continue
+		}
+		if report.Clock != nil {
+			t = t.Add(report.Clock.Redis)
+		}
+		if age := now.Sub(t); age > limit {
+			silent[report.Dyno] = fmt.Sprintf("%v is heartbeating but hasn't stored a result for %v (since %v)",
+				report.Dyno, age.Round(time.Second), t.UTC().Format(time.RFC3339))
+		}
+	}
+	return silent
+}
+
+func (a *Aggregator) rollup(entry historyEntry, samples []HistorySample, now time.Time) SLORollup {
+	rollup := SLORollup{Dyno: entry.dyno, Type: entry.resultType, Dest: entry.dest}
+	for _, w := range sloWindows {
+		window := SLOWindow{Window: w.name, Availability: 100, Met: true}
+		for _, sample := range samples {
+			if now.Sub(sample.Time) > w.duration {
+				break
+			}
+			window.Samples++
+			if sample.State == "fail" {
+				window.Failed++
+			}
+		}
+		if window.Samples > 0 {
+			window.Availability = 100 * float64(window.Samples-window.Failed) / float64(window.Samples)
+			window.Met = window.Availability >= a.sloTarget
+		}
+		rollup.Windows = append(rollup.Windows, window)
+	}
+	return rollup
+}
+
+func ntpSkew(clock *ClockOffset) string {
+	if clock.NTPServer == "" || clock.NTPError != "" {
+		return ""
+	}
+	return fmt.Sprintf(" and %v from %v", clock.NTP, clock.NTPServer)
+}
+
+func leadingFailures(samples []HistorySample) int {
+	for i, sample := range samples {
+		if sample.State != "fail" {
+			return i
+		}
+	}
+	return len(samples)
+}
+
+func describe(entry historyEntry) string {
+	if entry.dest == "" {
+		return fmt.Sprintf("%v %v check", entry.dyno, entry.resultType)
+	}
+	return fmt.Sprintf("%v %v check of %v", entry.dyno, entry.resultType, entry.dest)
+}
+
+func describeWindows(rollup SLORollup) string {
+	var windows []string
+	for _, window := range rollup.Windows {
+		windows = append(windows, fmt.Sprintf("%.2f%% over %v", window.Availability, window.Window))
+	}
+	return strings.Join(windows, ", ")
+}
+
+func latestResult(reports []Report, entry historyEntry) string {
+	for _, report := range reports {
+		if report.Dyno != entry.dyno {
+			continue
+		}
+		for _, category := range report.Categories() {
+			if category.Name != entry.resultType {
+				continue
+			}
+			for _, check := range category.Checks {
+				if check.Dest == entry.dest {
+					return check.Result
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// alert notifies about alerts that have started firing since the last run
+// and ones that have since resolved.  Alerts that are still firing aren't
+// repeated.
+func (a *Aggregator) alert(ctx context.Context, firing map[string]string) {
+	previous, err := a.redis.HGetAll(ctx, a.keys.alertsKey()).Result()
+	if err != nil {
+		log.WithError(err).Error("Unable to read alert state")
+		return
+	}
+
+	var ids []string
+	for id := range firing {
+		ids = append(ids, id)
+	}
+	for id := range previous {
+		if _, ok := firing[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		message, isFiring := firing[id]
+		_, wasFiring := previous[id]
+		switch {
+		case isFiring && !wasFiring:
+			a.notify(ctx, "FIRING", message)
+		case !isFiring && wasFiring:
+			a.notify(ctx, "RESOLVED", previous[id])
+		}
+	}
+
+	pipe := a.redis.TxPipeline()
+	pipe.Del(ctx, a.keys.alertsKey())
+	if len(firing) > 0 {
+		values := make(map[string]interface{})
+		for id, message := range firing {
+			values[id] = message
+		}
+		pipe.HSet(ctx, a.keys.alertsKey(), values)
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		log.WithError(err).Error("Unable to record alert state")
+	}
+}
+
+func (a *Aggregator) notify(ctx context.Context, status string, message string) {
+	logger := log.WithFields(log.Fields{
+		"fn":     "Aggregator.notify",
+		"status": status,
+	})
+	if status == "FIRING" {
+		logger.Error(message)
+	} else {
+		logger.Info(message)
+	}
+
+	if a.webhookURL == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, alertWebhookTimeout)
+	defer cancel()
+	err := requests.
+		URL(a.webhookURL).
+		BodyJSON(map[string]string{"text": fmt.Sprintf("[%v] %v", status, message)}).
+		Fetch(ctx)
+	if err != nil {
+		logger.WithError(err).Error("Unable to send alert webhook")
+	}
+}
+
+// sloBreaches returns the rollups the aggregator last found below target.
+func (c *Checker) sloBreaches(ctx context.Context) []SLORollup {
+	values, err := c.redis.HGetAll(ctx, c.keys.sloKey()).Result()
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch SLO rollups from redis")
+		return nil
+	}
+	var breaches []SLORollup
+	for _, value := range values {
+		var rollup SLORollup
+		if json.Unmarshal([]byte(value), &rollup) != nil || rollup.Met() {
+			continue
+		}
+		breaches = append(breaches, rollup)
+	}
+	sort.Slice(breaches, func(i, j int) bool {
+		if breaches[i].Dyno != breaches[j].Dyno {
+			return breaches[i].Dyno < breaches[j].Dyno
+		}
+		return breaches[i].Type+breaches[i].Dest < breaches[j].Type+breaches[j].Dest
+	})
+	return breaches
+}
@@ -0,0 +1,193 @@
+package liveness
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/archa347/ps-network-test/config"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRollup(t *testing.T) {
+	aggregator := &Aggregator{sloTarget: 99}
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	samples := func(states ...string) []HistorySample {
+		// Newest first, ten minutes apart, as history is stored.
+		var history []HistorySample
+		for i, state := range states {
+			history = append(history, HistorySample{Time: now.Add(-time.Duration(i) * 10 * time.Minute), State: state})
+		}
+		return history
+	}
+
+	tests := []struct {
+		name    string
+		samples []HistorySample
+		want    []SLOWindow
+	}{
+		{
+			name: "no samples",
+			want: []SLOWindow{
+				{Window: "1h", Availability: 100, Met: true},
+				{Window: "24h", Availability: 100, Met: true},
+			},
+		},
+		{
+			name:    "all passing",
+			samples: samples("pass", "warn", "pass"),
+			want: []SLOWindow{
+				{Window: "1h", Samples: 3, Availability: 100, Met: true},
+				{Window: "24h", Samples: 3, Availability: 100, Met: true},
+			},
+		},
+		{
+			name:    "failure outside the hour",
+			samples: samples("pass", "pass", "pass", "pass", "pass", "pass", "pass", "fail"),
+			want: []SLOWindow{
+				{Window: "1h", Samples: 7, Availability: 100, Met: true},
+				{Window: "24h", Samples: 8, Failed: 1, Availability: 87.5, Met: false},
+			},
+		},
+		{
+			name:    "stale isn't a failure",
+			samples: samples("stale", "fail"),
+			want: []SLOWindow{
+				{Window: "1h", Samples: 2, Failed: 1, Availability: 50, Met: false},
+				{Window: "24h", Samples: 2, Failed: 1, Availability: 50, Met: false},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rollup := aggregator.rollup(historyEntry{dyno: "web.1", resultType: "udp", dest: "web.2"}, tt.samples, now)
+			if !reflect.DeepEqual(rollup.Windows, tt.want) {
+				t.Errorf("windows = %+v, want %+v", rollup.Windows, tt.want)
+			}
+		})
+	}
+}
+
+func TestLeadingFailures(t *testing.T) {
+	tests := []struct {
+		states []string
+		want   int
+	}{
+		{states: nil, want: 0},
+		{states: []string{"pass", "fail"}, want: 0},
+		{states: []string{"fail", "fail", "pass", "fail"}, want: 2},
+		{states: []string{"fail", "stale"}, want: 1},
+		{states: []string{"fail", "fail", "fail"}, want: 3},
+	}
+	for _, tt := range tests {
+		var samples []HistorySample
+		for _, state := range tt.states {
+			samples = append(samples, HistorySample{State: state})
+		}
+		if got := leadingFailures(samples); got != tt.want {
+			t.Errorf("leadingFailures(%v) = %v, want %v", tt.states, got, tt.want)
+		}
+	}
+}
+
+func TestAlertOnlyNotifiesChanges(t *testing.T) {
+	var mu sync.Mutex
+	var sent []string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		mu.Lock()
+		sent = append(sent, body["text"])
+		mu.Unlock()
+	}))
+	defer webhook.Close()
+	_, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	aggregator := NewAggregator(config.Config{DynoID: "web.1", Namespace: "myapp", AlertWebhookURL: webhook.URL}, client, checker)
+	ctx := context.Background()
+
+	steps := []struct {
+		firing map[string]string
+		want   []string
+	}{
+		{
+			firing: map[string]string{"failing a": "a is failing", "failing b": "b is failing"},
+			want:   []string{"[FIRING] a is failing", "[FIRING] b is failing"},
+		},
+		{
+			firing: map[string]string{"failing a": "a is still failing", "failing b": "b is failing"},
+		},
+		{
+			firing: map[string]string{"failing a": "a is still failing"},
+			want:   []string{"[RESOLVED] b is failing"},
+		},
+		{
+			firing: map[string]string{},
+			want:   []string{"[RESOLVED] a is still failing"},
+		},
+	}
+	for i, step := range steps {
+		mu.Lock()
+		sent = nil
+		mu.Unlock()
+		aggregator.alert(ctx, step.firing)
+		mu.Lock()
+		got := sent
+		mu.Unlock()
+		if !reflect.DeepEqual(got, step.want) {
+			t.Errorf("step %v sent %q, want %q", i+1, got, step.want)
+		}
+	}
+}
+
+func TestAggregatorLock(t *testing.T) {
+	server, client := newTestStore(t)
+	server.RegisterScript(renewLock.Hash(), func(call func(args ...string) interface{}, keys []string, args []string) interface{} {
+		if call("GET", keys[0]) == args[0] {
+			return call("PEXPIRE", keys[0], args[1])
+		}
+		return 0
+	})
+	ctx := context.Background()
+	newAggregator := func(dyno string) *Aggregator {
+		return NewAggregator(config.Config{DynoID: dyno, Namespace: "myapp"}, client, newTestChecker(t, client, dyno))
+	}
+	first, second := newAggregator("aggregator.1"), newAggregator("aggregator.2")
+	lock := func(a *Aggregator) bool {
+		locked, err := a.lock(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return locked
+	}
+
+	if !lock(first) {
+		t.Fatal("aggregator.1 couldn't take a free lock")
+	}
+	if lock(second) {
+		t.Error("aggregator.2 took a lock aggregator.1 holds")
+	}
+
+	// Each run renews the lock, so aggregator.1 keeps it past its TTL.
+	for i := 0; i < 3; i++ {
+		server.FastForward(4 * time.Minute)
+		if !lock(first) {
+			t.Fatalf("aggregator.1 lost the lock on renewal %v", i+1)
+		}
+	}
+	if lock(second) {
+		t.Error("aggregator.2 took a renewed lock")
+	}
+
+	// Once aggregator.1 stops, the lock expires and aggregator.2 takes over.
+	server.FastForward(6 * time.Minute)
+	if !lock(second) {
+		t.Error("aggregator.2 couldn't take an expired lock")
+	}
+	if lock(first) {
+		t.Error("aggregator.1 renewed a lock aggregator.2 holds")
+	}
+}
@@ -0,0 +1,150 @@
+package liveness
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	"io"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+type AssertionError struct {
+	Assertion string
+	Detail    string
+}
+
+func (e *AssertionError) Error() string {
+	return fmt.Sprintf("%v: %v", e.Assertion, e.Detail)
+}
+
+func assertionFailed(assertion string, format string, args ...interface{}) error {
+	return &AssertionError{Assertion: assertion, Detail: fmt.Sprintf(format, args...)}
+}
+
+func hasBodyAssertions(a config.Assertions) bool {
+	return a.BodyContains != "" || a.BodyRegex != "" || len(a.JSON) > 0 || a.MaxBytes > 0
+}
+
+func checkStatus(a config.Assertions, res *http.Response) error {
+	if len(a.Status) == 0 {
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return assertionFailed("status", "got %v, want 2xx", res.StatusCode)
+		}
+		return nil
+	}
+	for _, status := range a.Status {
+		if res.StatusCode == status {
+			return nil
+		}
+	}
+	return assertionFailed("status", "got %v, want one of %v", res.StatusCode, a.Status)
+}
+
+// checkHeaders requires each listed header to be present.  An empty expected
+// value only checks presence.
+func checkHeaders(a config.Assertions, res *http.Response) error {
+	for name, want := range a.Headers {
+		values, ok := res.Header[http.CanonicalHeaderKey(name)]
+		if !ok {
+			return assertionFailed("header", "%v missing", name)
+		}
+		if want != "" && !containsString(values, want) {
+			return assertionFailed("header", "%v is %q, want %q", name, strings.Join(values, ","), want)
+		}
+	}
+	return nil
+}
+
+func readBody(a config.Assertions, res *http.Response) ([]byte, error) {
+	var r io.Reader = res.Body
+	if a.MaxBytes > 0 {
+		r = io.LimitReader(res.Body, a.MaxBytes+1)
+	}
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if a.MaxBytes > 0 && int64(len(body)) > a.MaxBytes {
+		return nil, assertionFailed("max_bytes", "response larger than %v bytes", a.MaxBytes)
+	}
+	return body, nil
+}
+
+func checkBody(a config.Assertions, body []byte) error {
+	if a.BodyContains != "" && !bytes.Contains(body, []byte(a.BodyContains)) {
+		return assertionFailed("body_contains", "%q not found", a.BodyContains)
+	}
+	if a.BodyRegex != "" {
+		re, err := regexp.Compile(a.BodyRegex)
+		if err != nil {
+			return assertionFailed("body_regex", "invalid regex %q: %v", a.BodyRegex, err)
+		}
+		if !re.Match(body) {
+			return assertionFailed("body_regex", "%q did not match", a.BodyRegex)
+		}
+	}
+	if len(a.JSON) > 0 {
+		var doc interface{}
+		err := json.Unmarshal(body, &doc)
+		if err != nil {
+			return assertionFailed("json", "body is not JSON: %v", err)
+		}
+		for path, want := range a.JSON {
+			got, ok := jsonPath(doc, path)
+			if !ok {
+				return assertionFailed("json", "%v not found", path)
+			}
+			if !reflect.DeepEqual(got, want) {
+				return assertionFailed("json", "%v is %v, want %v", path, jsonString(got), jsonString(want))
+			}
+		}
+	}
+	return nil
+}
+
+// jsonPath resolves a dotted path such as "data.items.0.id" against a decoded
+// JSON document.  Numeric segments index into arrays.
+func jsonPath(doc interface{}, path string) (interface{}, bool) {
+	current := doc
+	for _, segment := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[segment]
+			if !ok {
+				return nil, false
+			}
+			current = value
+		case []interface{}:
+			i, err := strconv.Atoi(segment)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			current = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func jsonString(v interface{}) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+	return string(data)
+}
+
+func containsString(values []string, want string) bool {
+	for _, value := range values {
+		if value == want {
+			return true
+		}
+	}
+	return false
+}
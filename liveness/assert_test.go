@@ -0,0 +1,165 @@
+package liveness
+
+import (
+	"errors"
+	"github.com/archa347/ps-network-test/config"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// wantAssertion checks err is an AssertionError for assertion, or nil when
+// assertion is empty.
+func wantAssertion(t *testing.T, err error, assertion string) {
+	t.Helper()
+	if assertion == "" {
+		if err != nil {
+			t.Errorf("got %v, want a pass", err)
+		}
+		return
+	}
+	var failed *AssertionError
+	if !errors.As(err, &failed) || failed.Assertion != assertion {
+		t.Errorf("got %v, want a %v assertion failure", err, assertion)
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		status []int
+		got    int
+		want   string
+	}{
+		{name: "default 2xx", got: 204},
+		{name: "default rejects redirect", got: 302, want: "status"},
+		{name: "default rejects server error", got: 500, want: "status"},
+		{name: "listed", status: []int{200, 404}, got: 404},
+		{name: "not listed", status: []int{200}, got: 201, want: "status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkStatus(config.Assertions{Status: tt.status}, &http.Response{StatusCode: tt.got})
+			wantAssertion(t, err, tt.want)
+		})
+	}
+}
+
+func TestCheckHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("Content-Type", "application/json")
+	header.Add("Vary", "Accept")
+	header.Add("Vary", "Origin")
+	res := &http.Response{Header: header}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{name: "none"},
+		{name: "value", headers: map[string]string{"Content-Type": "application/json"}},
+		{name: "name is case insensitive", headers: map[string]string{"content-type": "application/json"}},
+		{name: "presence only", headers: map[string]string{"Vary": ""}},
+		{name: "any of several values", headers: map[string]string{"Vary": "Origin"}},
+		{name: "missing", headers: map[string]string{"X-Request-Id": ""}, want: "header"},
+		{name: "wrong value", headers: map[string]string{"Content-Type": "text/html"}, want: "header"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantAssertion(t, checkHeaders(config.Assertions{Headers: tt.headers}, res), tt.want)
+		})
+	}
+}
+
+func TestCheckBody(t *testing.T) {
+	body := []byte(`{"status": "up", "version": 3, "checks": [{"name": "db", "healthy": true}], "tags": null}`)
+	tests := []struct {
+		name string
+		a    config.Assertions
+		body []byte
+		want string
+	}{
+		{name: "none", body: body},
+		{name: "contains", a: config.Assertions{BodyContains: `"up"`}, body: body},
+		{name: "does not contain", a: config.Assertions{BodyContains: "down"}, body: body, want: "body_contains"},
+		{name: "regex", a: config.Assertions{BodyRegex: `"version": \d+`}, body: body},
+		{name: "regex does not match", a: config.Assertions{BodyRegex: `^\[`}, body: body, want: "body_regex"},
+		{name: "invalid regex", a: config.Assertions{BodyRegex: `(`}, body: body, want: "body_regex"},
+		{
+			name: "json values",
+			a: config.Assertions{JSON: map[string]interface{}{
+				"status": "up", "version": float64(3), "checks.0.healthy": true, "tags": nil,
+			}},
+			body: body,
+		},
+		{name: "json value differs", a: config.Assertions{JSON: map[string]interface{}{"status": "down"}}, body: body, want: "json"},
+		{name: "json type differs", a: config.Assertions{JSON: map[string]interface{}{"version": "3"}}, body: body, want: "json"},
+		{name: "json path missing", a: config.Assertions{JSON: map[string]interface{}{"checks.1.name": "db"}}, body: body, want: "json"},
+		{name: "not json", a: config.Assertions{JSON: map[string]interface{}{"status": "up"}}, body: []byte("<html>"), want: "json"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wantAssertion(t, checkBody(tt.a, tt.body), tt.want)
+		})
+	}
+}
+
+func TestReadBodyMaxBytes(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		body     string
+		want     string
+	}{
+		{name: "unlimited", body: strings.Repeat("x", 100)},
+		{name: "at the limit", maxBytes: 10, body: strings.Repeat("x", 10)},
+		{name: "over the limit", maxBytes: 10, body: strings.Repeat("x", 11), want: "max_bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{Body: io.NopCloser(strings.NewReader(tt.body))}
+			body, err := readBody(config.Assertions{MaxBytes: tt.maxBytes}, res)
+			wantAssertion(t, err, tt.want)
+			if err == nil && string(body) != tt.body {
+				t.Errorf("read %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
+
+func TestJSONPath(t *testing.T) {
+	doc := map[string]interface{}{
+		"data": map[string]interface{}{
+			"items": []interface{}{
+				map[string]interface{}{"id": "a"},
+				map[string]interface{}{"id": "b"},
+			},
+		},
+		"count": float64(2),
+	}
+	tests := []struct {
+		path   string
+		want   interface{}
+		wantOK bool
+	}{
+		{path: "count", want: float64(2), wantOK: true},
+		{path: "data.items.1.id", want: "b", wantOK: true},
+		{path: "data.items.0", want: map[string]interface{}{"id": "a"}, wantOK: true},
+		{path: "data.missing"},
+		{path: "data.items.2.id"},
+		{path: "data.items.-1"},
+		{path: "data.items.first"},
+		{path: "count.value"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			got, ok := jsonPath(doc, tt.path)
+			if ok != tt.wantOK || !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, %v, want %v, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
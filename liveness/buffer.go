@@ -0,0 +1,234 @@
+package liveness
+
+import (
+	"context"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	redisclient "github.com/archa347/ps-network-test/redis"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const outageHistoryLength = 50
+
+// lastResultTTL is how long a dyno's last result time outlives its results.
+const lastResultTTL = 24 * time.Hour
+
+type bufferedWrite struct {
+	key   string
+	value string
+	ttl   time.Duration
+	at    time.Time
+
+	// indexKey, when set, is a set the key is registered in alongside the
+	// write so readers can find it without scanning.
+	indexKey    string
+	indexMember string
+
+	// crossSlot is set when indexKey doesn't share key's hash tag, so the two
+	// are pipelined rather than written in one transaction.
+	crossSlot bool
+
+	// stampKey, when set, is written with the time of the write, e.g. to
+	// record when a dyno last stored a result.
+	stampKey string
+}
+
+// WriteBuffer holds writes that failed while redis was unreachable and
+// replays them once it's back.  Values already carry the time they were
+// recorded, and replayed keys only live for what's left of their TTL, so a
+// heartbeat from the middle of an outage doesn't resurrect a dead dyno.
+type WriteBuffer struct {
+	redis redisclient.Store
+	dyno  string
+	keys  keyspace
+	max   int
+
+	mu          sync.Mutex
+	writes      []bufferedWrite
+	index       map[string]int
+	dropped     int
+	buffered    int
+	outageStart time.Time
+}
+
+func NewWriteBuffer(cfg config.Config, client redisclient.Store) *WriteBuffer {
+	return &WriteBuffer{
+		redis: client,
+		dyno:  cfg.DynoID,
+		keys:  keyspace(cfg.Namespace),
+		max:   cfg.RedisBufferSize,
+		index: make(map[string]int),
+	}
+}
+
+// Set writes through to redis, buffering the write if redis fails.  The
+// error is still returned so callers can log it.
+func (b *WriteBuffer) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	_, err := b.write(ctx, bufferedWrite{key: key, value: value, ttl: ttl, at: time.Now()})
+	return err
+}
+
+// SetMember is Set that also adds member to the set at setKey, like a dyno's
+// heartbeat and its entry in the dynos set, so an outage replays both.  The
+// keys can be in different slots.  It reports whether member was new to the
+// set; a buffered write never is.
+func (b *WriteBuffer) SetMember(ctx context.Context, key string, value string, ttl time.Duration, setKey string, member string) (bool, error) {
+	return b.write(ctx, bufferedWrite{key: key, value: value, ttl: ttl, at: time.Now(), indexKey: setKey, indexMember: member, crossSlot: true})
+}
+
+// SetResult is Set for one of this dyno's results: member is added to the
+// dyno's results index and its last result time is stamped in the same
+// transaction, so the three can't disagree.  key must share the dyno's hash
+// tag.
+func (b *WriteBuffer) SetResult(ctx context.Context, key string, value string, ttl time.Duration, member string) error {
+	_, err := b.write(ctx, bufferedWrite{
+		key:         key,
+		value:       value,
+		ttl:         ttl,
+		at:          time.Now(),
+		indexKey:    b.keys.resultsIndexKey(b.dyno),
+		indexMember: member,
+		stampKey:    b.keys.lastResultKey(b.dyno),
+	})
+	return err
+}
+
+func (b *WriteBuffer) write(ctx context.Context, write bufferedWrite) (bool, error) {
+	if b.InOutage() {
+		b.add(write)
+		return false, nil
+	}
+	if write.indexKey == "" && write.stampKey == "" {
+		err := b.redis.Set(ctx, write.key, write.value, write.ttl).Err()
+		if err != nil {
+			b.add(write)
+		}
+		return false, err
+	}
+
+	var pipe redis.Pipeliner
+	if write.crossSlot {
+		pipe = b.redis.Pipeline()
+	} else {
+		pipe = b.redis.TxPipeline()
+	}
+	pipe.Set(ctx, write.key, write.value, write.ttl)
+	var added *redis.IntCmd
+	if write.indexKey != "" {
+		added = pipe.SAdd(ctx, write.indexKey, write.indexMember)
+	}
+	if write.stampKey != "" {
+		pipe.Set(ctx, write.stampKey, write.at.Format(time.RFC3339), lastResultTTL)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		b.add(write)
+		return false, err
+	}
+	return added != nil && added.Val() > 0, nil
+}
+
+func (b *WriteBuffer) InOutage() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.outageStart.IsZero()
+}
+
+func (b *WriteBuffer) add(write bufferedWrite) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.outageStart.IsZero() {
+		b.outageStart = write.at
+		log.WithField("dyno", b.dyno).Warn("Redis outage started, buffering writes")
+	}
+	b.buffered++
+	if i, ok := b.index[write.key]; ok {
+		// The newer write moves to the back, so replay applies writes in the
+		// order they were made and shared keys like the last result time end
+		// up with the latest value.
+		b.remove(i)
+	} else if len(b.writes) >= b.max {
+		b.remove(0)
+		b.dropped++
+	}
+	b.index[write.key] = len(b.writes)
+	b.writes = append(b.writes, write)
+}
+
+// remove drops the buffered write at i.  Must be called with b.mu held.
+func (b *WriteBuffer) remove(i int) {
+	delete(b.index, b.writes[i].key)
+	b.writes = append(b.writes[:i], b.writes[i+1:]...)
+	for key, j := range b.index {
+		if j > i {
+			b.index[key] = j - 1
+		}
+	}
+}
+
+func (b *WriteBuffer) Start() {
+	go func() {
+		for {
+			time.Sleep(5 * time.Second)
+			if b.InOutage() {
+				b.replay(context.Background())
+			}
+		}
+	}()
+}
+
+// replay holds the lock throughout so writes arriving mid-replay wait and
+// then go straight to redis rather than landing in a buffer being emptied.
+func (b *WriteBuffer) replay(ctx context.Context) {
+	err := b.redis.Ping(ctx).Err()
+	if err != nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	replayed, expired := 0, 0
+	pipe := b.redis.Pipeline()
+	for _, write := range b.writes {
+		ttl := write.ttl
+		if ttl > 0 {
+			ttl -= now.Sub(write.at)
+			if ttl <= 0 {
+				expired++
+				continue
+			}
+		}
+		pipe.Set(ctx, write.key, write.value, ttl)
+		if write.indexKey != "" {
+			pipe.SAdd(ctx, write.indexKey, write.indexMember)
+		}
+		if write.stampKey != "" {
+			pipe.Set(ctx, write.stampKey, write.at.Format(time.RFC3339), lastResultTTL-now.Sub(write.at))
+		}
+		replayed++
+	}
+
+	outage := fmt.Sprintf("%v to %v (%v): %v writes buffered, %v replayed, %v expired, %v dropped",
+		b.outageStart.Format(time.RFC3339), now.Format(time.RFC3339), now.Sub(b.outageStart).Round(time.Second),
+		b.buffered, replayed, expired, b.dropped)
+	pipe.LPush(ctx, b.keys.outagesKey(b.dyno), outage)
+	pipe.LTrim(ctx, b.keys.outagesKey(b.dyno), 0, outageHistoryLength-1)
+
+	_, err = pipe.Exec(ctx)
+	logger := log.WithField("dyno", b.dyno).WithField("outage", outage)
+	if err != nil {
+		logger.WithError(err).Error("Unable to replay buffered writes")
+		return
+	}
+	logger.Info("Redis outage ended, replayed buffered writes")
+
+	b.writes = nil
+	b.index = make(map[string]int)
+	b.outageStart = time.Time{}
+	b.buffered, b.dropped = 0, 0
+}
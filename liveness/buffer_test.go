@@ -0,0 +1,146 @@
+package liveness
+
+import (
+	"context"
+	"github.com/archa347/ps-network-test/config"
+	"github.com/archa347/ps-network-test/redis"
+	"github.com/archa347/ps-network-test/redis/memstore"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestBuffer(t *testing.T, max int) (*memstore.Server, redis.Store, *WriteBuffer) {
+	server, client := newTestStore(t)
+	buffer := NewWriteBuffer(config.Config{DynoID: "web.1", Namespace: "myapp", RedisBufferSize: max}, client)
+	return server, client, buffer
+}
+
+func TestBufferReplaysAfterOutage(t *testing.T) {
+	server, client, buffer := newTestBuffer(t, 10)
+	keys := buffer.keys
+	ctx := context.Background()
+
+	server.SetDown(true)
+	err := buffer.Set(ctx, keys.livenessKey("web.1"), "healthy", time.Minute)
+	if err == nil {
+		t.Fatal("write to a down redis succeeded")
+	}
+	if !buffer.InOutage() {
+		t.Fatal("failed write didn't start an outage")
+	}
+	// Once in an outage, writes are buffered without trying redis.
+	err = buffer.SetResult(ctx, keys.checkKey("udp", "web.1", "web.2"), "pass", time.Minute, resultsIndexMember("udp", "web.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// replay waits for redis to answer.
+	buffer.replay(ctx)
+	if !buffer.InOutage() {
+		t.Fatal("outage ended while redis was still down")
+	}
+
+	server.SetDown(false)
+	buffer.replay(ctx)
+	if buffer.InOutage() {
+		t.Fatal("outage didn't end after replay")
+	}
+	if value, _ := client.Get(ctx, keys.checkKey("udp", "web.1", "web.2")).Result(); value != "pass" {
+		t.Errorf("result = %q, want pass", value)
+	}
+	if ttl, _ := client.TTL(ctx, keys.livenessKey("web.1")).Result(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("replayed heartbeat ttl = %v, want what's left of a minute", ttl)
+	}
+	if member, _ := client.SIsMember(ctx, keys.resultsIndexKey("web.1"), "udp|web.2").Result(); !member {
+		t.Error("replayed result missing from the index")
+	}
+	if n, _ := client.Exists(ctx, keys.lastResultKey("web.1")).Result(); n != 1 {
+		t.Error("replayed result didn't stamp the last result time")
+	}
+
+	outages, _ := client.LRange(ctx, keys.outagesKey("web.1"), 0, -1).Result()
+	if len(outages) != 1 || !strings.Contains(outages[0], "2 writes buffered, 2 replayed, 0 expired, 0 dropped") {
+		t.Errorf("outages = %q", outages)
+	}
+}
+
+func TestBufferReplayOrderAndExpiry(t *testing.T) {
+	_, client, buffer := newTestBuffer(t, 10)
+	keys := buffer.keys
+	ctx := context.Background()
+
+	start := time.Now().Truncate(time.Second)
+	result := func(dest string, value string, at time.Time, ttl time.Duration) bufferedWrite {
+		return bufferedWrite{
+			key: keys.checkKey("udp", "web.1", dest), value: value, ttl: ttl, at: at,
+			indexKey: keys.resultsIndexKey("web.1"), indexMember: resultsIndexMember("udp", dest),
+			stampKey: keys.lastResultKey("web.1"),
+		}
+	}
+	buffer.add(result("web.2", "fail", start.Add(-3*time.Second), time.Minute))
+	buffer.add(result("web.3", "pass", start.Add(-2*time.Second), time.Minute))
+	buffer.add(result("web.2", "pass", start.Add(-time.Second), time.Minute))
+	buffer.add(result("web.4", "pass", start.Add(-2*time.Minute), time.Minute))
+	buffer.replay(ctx)
+
+	if value, _ := client.Get(ctx, keys.checkKey("udp", "web.1", "web.2")).Result(); value != "pass" {
+		t.Errorf("web.2 = %q, want the later write", value)
+	}
+	if stamp, _ := client.Get(ctx, keys.lastResultKey("web.1")).Result(); stamp != start.Add(-time.Second).Format(time.RFC3339) {
+		t.Errorf("last result stamped %v, want the latest write's time", stamp)
+	}
+	if n, _ := client.Exists(ctx, keys.checkKey("udp", "web.1", "web.4")).Result(); n != 0 {
+		t.Error("write whose TTL ran out during the outage was replayed")
+	}
+	outages, _ := client.LRange(ctx, keys.outagesKey("web.1"), 0, -1).Result()
+	if len(outages) != 1 || !strings.Contains(outages[0], "4 writes buffered, 2 replayed, 1 expired, 0 dropped") {
+		t.Errorf("outages = %q", outages)
+	}
+}
+
+func TestBufferSizeCap(t *testing.T) {
+	_, client, buffer := newTestBuffer(t, 3)
+	keys := buffer.keys
+	ctx := context.Background()
+
+	for _, dyno := range []string{"web.1", "web.2", "web.3", "web.4", "web.5"} {
+		buffer.add(bufferedWrite{key: keys.livenessKey(dyno), value: "healthy", ttl: time.Minute, at: time.Now()})
+	}
+	buffer.replay(ctx)
+
+	for dyno, want := range map[string]int64{"web.1": 0, "web.2": 0, "web.3": 1, "web.4": 1, "web.5": 1} {
+		if n, _ := client.Exists(ctx, keys.livenessKey(dyno)).Result(); n != want {
+			t.Errorf("%v exists = %v, want %v", dyno, n, want)
+		}
+	}
+	outages, _ := client.LRange(ctx, keys.outagesKey("web.1"), 0, -1).Result()
+	if len(outages) != 1 || !strings.Contains(outages[0], "5 writes buffered, 3 replayed, 0 expired, 2 dropped") {
+		t.Errorf("outages = %q", outages)
+	}
+}
+
+func TestHeartbeatMembershipIsBuffered(t *testing.T) {
+	server, client, buffer := newTestBuffer(t, 10)
+	keys := buffer.keys
+	ctx := context.Background()
+
+	added, err := buffer.SetMember(ctx, keys.livenessKey("web.1"), "healthy", time.Minute, keys.dynosKey(), "web.1")
+	if err != nil || !added {
+		t.Fatalf("first heartbeat: added = %v, err = %v", added, err)
+	}
+	added, _ = buffer.SetMember(ctx, keys.livenessKey("web.1"), "healthy", time.Minute, keys.dynosKey(), "web.1")
+	if added {
+		t.Error("second heartbeat reported web.1 as new")
+	}
+
+	// The dynos set is lost while redis is down, e.g. to a failover.
+	client.Del(ctx, keys.dynosKey())
+	server.SetDown(true)
+	buffer.SetMember(ctx, keys.livenessKey("web.1"), "healthy", time.Minute, keys.dynosKey(), "web.1")
+	server.SetDown(false)
+	buffer.replay(ctx)
+	if member, _ := client.SIsMember(ctx, keys.dynosKey(), "web.1").Result(); !member {
+		t.Error("replayed heartbeat didn't restore web.1's membership")
+	}
+}
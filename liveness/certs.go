@@ -0,0 +1,116 @@
+package liveness
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+type CertInfo struct {
+	Subject  string
+	Issuer   string
+	SANs     []string
+	NotAfter time.Time
+}
+
+func (i CertInfo) DaysUntilExpiry(now time.Time) int {
+	return int(i.NotAfter.Sub(now).Hours() / 24)
+}
+
+// peerCertInfo describes the leaf of the peer chain, but with the earliest
+// expiry anywhere in the chain, since an expiring intermediate breaks clients
+// just as surely as an expiring leaf.
+func peerCertInfo(state *tls.ConnectionState) (CertInfo, bool) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return CertInfo{}, false
+	}
+	leaf := state.PeerCertificates[0]
+	info := CertInfo{
+		Subject:  leaf.Subject.String(),
+		Issuer:   leaf.Issuer.String(),
+		SANs:     append([]string{}, leaf.DNSNames...),
+		NotAfter: leaf.NotAfter,
+	}
+	for _, ip := range leaf.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	for _, cert := range state.PeerCertificates[1:] {
+		if cert.NotAfter.Before(info.NotAfter) {
+			info.NotAfter = cert.NotAfter
+		}
+	}
+	return info, true
+}
+
+func certResult(info CertInfo, warnDays []int, now time.Time) string {
+	days := info.DaysUntilExpiry(now)
+	detail := fmt.Sprintf("subject=%v issuer=%v sans=%v notAfter=%v",
+		info.Subject, info.Issuer, strings.Join(info.SANs, ","), info.NotAfter.Format(time.RFC3339))
+
+	if !now.Before(info.NotAfter) {
+		return fmt.Sprintf("fail:expired %v days ago:%v:%v", -days, detail, timeTag())
+	}
+
+	thresholds := append([]int{}, warnDays...)
+	sort.Ints(thresholds)
+	for _, threshold := range thresholds {
+		if days <= threshold {
+			return fmt.Sprintf("warn:expires in %v days (%v day threshold):%v:%v", days, threshold, detail, timeTag())
+		}
+	}
+	return fmt.Sprintf("pass:expires in %v days:%v:%v", days, detail, timeTag())
+}
+
+// certificateError reports whether err came from verifying the peer's
+// certificate chain.
+func certificateError(err error) bool {
+	var hostnameErr x509.HostnameError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var certInvalidErr x509.CertificateInvalidError
+	return errors.As(err, &hostnameErr) || errors.As(err, &unknownAuthErr) || errors.As(err, &certInvalidErr)
+}
+
+// inspectPeerChain reads the chain presented at rawURL without verifying it.
+// A handshake that fails verification leaves no connection state behind, so
+// this is how an expired or otherwise rejected certificate still gets
+// reported.
+func inspectPeerChain(ctx context.Context, rawURL string) (*tls.ConnectionState, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	// The chain is captured as soon as the server presents it, since a
+	// server requiring a client certificate may still abort the handshake.
+	var state *tls.ConnectionState
+	dialer := &tls.Dialer{
+		NetDialer: &net.Dialer{Timeout: 10 * time.Second},
+		Config: &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: true,
+			VerifyConnection: func(cs tls.ConnectionState) error {
+				state = &cs
+				return nil
+			},
+		},
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if conn != nil {
+		conn.Close()
+	}
+	if state == nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -0,0 +1,248 @@
+package liveness
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// sparklineWindow is how much history the report page's sparklines cover.
+const sparklineWindow = time.Hour
+
+// HistoryWindows are the windows the drill-down page offers.  The longest
+// should fit in HISTORY_LENGTH samples at the aggregator's interval.
+var HistoryWindows = []string{"1h", "6h", "24h"}
+
+var stateColors = map[string]string{
+	"pass":  "lightgreen",
+	"warn":  "khaki",
+	"fail":  "lightpink",
+	"stale": "lightgray",
+}
+
+var valueUnits = map[string]string{
+	"latency":    "ms avg",
+	"redis":      "ms ping",
+	"udp":        "% loss",
+	"throughput": "Mbps down",
+}
+
+// Chart is an SVG chart laid out ahead of time so the template only has to
+// draw it: a bar per sample coloured by state, and a line through the
+// measured values for checks that have them.
+type Chart struct {
+	Width  int
+	Height int
+	Bars   []ChartBar
+	Line   string
+	Min    float64
+	Max    float64
+	Unit   string
+	Link   string
+}
+
+type ChartBar struct {
+	X     float64
+	Width float64
+	Color string
+	Title string
+}
+
+// newChart lays out samples, newest first as they're stored, over the window
+// ending at end.
+func newChart(resultType string, samples []HistorySample, window time.Duration, end time.Time, width int, height int) *Chart {
+	start := end.Add(-window)
+	var shown []HistorySample
+	for _, sample := range samples {
+		if sample.Time.Before(start) {
+			break
+		}
+		shown = append(shown, sample)
+	}
+	if len(shown) == 0 {
+		return nil
+	}
+	sort.Slice(shown, func(i, j int) bool { return shown[i].Time.Before(shown[j].Time) })
+
+	chart := &Chart{Width: width, Height: height, Unit: valueUnits[resultType]}
+	x := func(t time.Time) float64 {
+		return float64(width) * float64(t.Sub(start)) / float64(window)
+	}
+
+	// Bars are as wide as the usual gap between samples, so a gap in the
+	// history shows up as a gap in the chart.
+	gap := time.Minute
+	if len(shown) > 1 {
+		gap = shown[len(shown)-1].Time.Sub(shown[0].Time) / time.Duration(len(shown)-1)
+	}
+	barWidth := float64(width) * float64(gap) / float64(window)
+	if barWidth < 1 {
+		barWidth = 1
+	}
+	for _, sample := range shown {
+		chart.Bars = append(chart.Bars, ChartBar{
+			X:     x(sample.Time) - barWidth,
+			Width: barWidth,
+			Color: stateColors[sample.State],
+			Title: fmt.Sprintf("%v %v", sample.Time.UTC().Format(time.RFC3339), sample.State),
+		})
+	}
+
+	if chart.Unit == "" {
+		return chart
+	}
+	var measured []HistorySample
+	for _, sample := range shown {
+		if sample.State == "pass" || sample.State == "warn" {
+			measured = append(measured, sample)
+		}
+	}
+	if len(measured) == 0 {
+		return chart
+	}
+	chart.Min, chart.Max = measured[0].Value, measured[0].Value
+	for _, sample := range measured {
+		if sample.Value < chart.Min {
+			chart.Min = sample.Value
+		}
+		if sample.Value > chart.Max {
+			chart.Max = sample.Value
+		}
+	}
+	var points []string
+	for _, sample := range measured {
+		y := float64(height) / 2
+		if chart.Max > chart.Min {
+			// Leave a pixel at the top and bottom so the line isn't clipped.
+			y = 1 + float64(height-2)*(chart.Max-sample.Value)/(chart.Max-chart.Min)
+		}
+		points = append(points, fmt.Sprintf("%.1f,%.1f", x(sample.Time)-barWidth/2, y))
+	}
+	chart.Line = strings.Join(points, " ")
+	return chart
+}
+
+func historyLink(dyno string, resultType string, dest string, window string) string {
+	query := url.Values{}
+	query.Set("dyno", dyno)
+	query.Set("type", resultType)
+	query.Set("dest", dest)
+	query.Set("window", window)
+	return "/report/history?" + query.Encode()
+}
+
+func parseHistory(values []string) []HistorySample {
+	var samples []HistorySample
+	for _, value := range values {
+		if sample, ok := parseSample(value); ok {
+			samples = append(samples, sample)
+		}
+	}
+	return samples
+}
+
+// attachSparklines gives each check in reports a sparkline of the last
+// sparklineWindow of its history, in one round trip.  The aggregator samples
+// once a minute by default, so that's all that's read.
+func (c *Checker) attachSparklines(ctx context.Context, reports []Report) {
+	type pending struct {
+		dyno       string
+		resultType string
+		check      *CheckReport
+		cmd        *redis.StringSliceCmd
+	}
+	var sparklines []pending
+
+	pipe := c.redis.Pipeline()
+	for i := range reports {
+		report := &reports[i]
+		for _, category := range report.Categories() {
+			for j := range category.Checks {
+				check := &category.Checks[j]
+				key := c.keys.historyKey(report.Dyno, resultsIndexMember(category.Name, check.Dest))
+				sparklines = append(sparklines, pending{
+					dyno:       report.Dyno,
+					resultType: category.Name,
+					check:      check,
+					cmd:        pipe.LRange(ctx, key, 0, int64(sparklineWindow/time.Minute)-1),
+				})
+			}
+		}
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch history from redis")
+	}
+
+	now := time.Now()
+	for _, s := range sparklines {
+		s.check.Spark = newChart(s.resultType, parseHistory(s.cmd.Val()), sparklineWindow, now, 120, 18)
+		if s.check.Spark != nil {
+			s.check.Spark.Link = historyLink(s.dyno, s.resultType, s.check.Dest, HistoryWindows[0])
+		}
+	}
+}
+
+// History is the drill-down page for one check: its state and, where it
+// measures something, its values over window.
+func (c *Checker) History(ctx context.Context, dyno string, resultType string, dest string, window string) map[string]interface{} {
+	duration, err := time.ParseDuration(window)
+	if err != nil || !containsString(HistoryWindows, window) {
+		window = HistoryWindows[0]
+		duration, _ = time.ParseDuration(window)
+	}
+
+	values, err := c.redis.LRange(ctx, c.keys.historyKey(dyno, resultsIndexMember(resultType, dest)), 0, -1).Result()
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch history from redis")
+	}
+	samples := parseHistory(values)
+	now := time.Now()
+
+	var windows []map[string]interface{}
+	for _, w := range HistoryWindows {
+		windows = append(windows, map[string]interface{}{
+			"name":     w,
+			"link":     historyLink(dyno, resultType, dest, w),
+			"selected": w == window,
+		})
+	}
+
+	total, failed := 0, 0
+	var failures []HistorySample
+	for _, sample := range samples {
+		if now.Sub(sample.Time) > duration {
+			break
+		}
+		total++
+		if sample.State == "fail" {
+			failed++
+			if len(failures) < 50 {
+				failures = append(failures, sample)
+			}
+		}
+	}
+	availability := 100.0
+	if total > 0 {
+		availability = 100 * float64(total-failed) / float64(total)
+	}
+
+	return map[string]interface{}{
+		"dyno":         dyno,
+		"type":         resultType,
+		"dest":         dest,
+		"window":       window,
+		"windows":      windows,
+		"timeline":     newChart("", samples, duration, now, 720, 24),
+		"values":       newChart(resultType, samples, duration, now, 720, 160),
+		"samples":      total,
+		"failed":       failed,
+		"availability": availability,
+		"failures":     failures,
+	}
+}
@@ -2,133 +2,277 @@ package liveness
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"github.com/archa347/ps-network-test/config"
+	"github.com/archa347/ps-network-test/dns"
+	"github.com/archa347/ps-network-test/gossip"
+	redisclient "github.com/archa347/ps-network-test/redis"
 	"github.com/carlmjohnson/requests"
-	"github.com/go-redis/redis/v8"
 	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 )
 
 type Checker struct {
-	appName          string
-	dyno             string
-	defaultNATCheck  string
-	redis            *redis.Client
-	checkPrivateCron string
-	checkNATCron     string
-	checkDMZCron     string
+	appName           string
+	dyno              string
+	keys              keyspace
+	defaultNATCheck   string
+	redis             redisclient.Store
+	checkPrivateCron  string
+	checkNATCron      string
+	checkDMZCron      string
+	privateScheme     string
+	privateClient     *http.Client
+	privateTLS        *tls.Config
+	certWarnDays      []int
+	targets           []config.Target
+	checkUDPCron      string
+	udpPort           string
+	udpBurstCount     int
+	throughputCron    string
+	throughputBytes   int64
+	throughputTimeout time.Duration
+	throughputPort    string
+	checkLatencyCron  string
+	latencySamples    int
+	checkDNSCron      string
+	dnsResolvers      []string
+	dnsNames          []string
+	peerDiscovery     string
+	peerDNSName       string
+	privateIP         string
+	gossip            *gossip.Node
+	gossipPort        string
+	buffer            *WriteBuffer
+	checkRedisCron    string
+	redisLatencyWarn  time.Duration
+	staleAfter        map[string]time.Duration
+	clockSkewWarn     time.Duration
+	migrated          uint32
 }
 
 type Report struct {
-	Dyno    string
-	DMZ     []CheckReport
-	NAT     []CheckReport
-	Private []CheckReport
+	Dyno       string
+	DMZ        []CheckReport
+	NAT        []CheckReport
+	Private    []CheckReport
+	Certs      []CheckReport
+	UDP        []CheckReport
+	Throughput []CheckReport
+	Latency    []CheckReport
+	DNS        []CheckReport
+	Redis      []CheckReport
+	Manual     []CheckReport
+	Clock      *ClockOffset
+	Outages    []string
 }
 
 type CheckReport struct {
 	Dest   string
 	Result string
+	Trend  string
+	Spark  *Chart `json:",omitempty"`
+	Age    Age
+	Stale  bool
 }
 
 func (r *CheckReport) Passed() bool {
 	return strings.HasPrefix(r.Result, "pass") || strings.HasPrefix(r.Result, "healthy")
 }
 
-func NewChecker(cfg config.Config, red *redis.Client) *Checker {
+func (r *CheckReport) Warned() bool {
+	return strings.HasPrefix(r.Result, "warn")
+}
+
+// State is pass, warn or fail from the result itself, or stale if the result
+// is older than its check's schedule allows, whatever it says.
+func (r *CheckReport) State() string {
+	switch {
+	case r.Stale:
+		return "stale"
+	case r.Passed():
+		return "pass"
+	case r.Warned():
+		return "warn"
+	}
+	return "fail"
+}
+
+// ReportCell is a check as a cell on the report page, labelled with where it
+// came from so live results can find it.
+type ReportCell struct {
+	*CheckReport
+	Check string
+}
+
+// Cell labels the check as dyno's result of type resultType, for the "cell"
+// template.
+func (r *CheckReport) Cell(dyno string, resultType string) ReportCell {
+	return ReportCell{CheckReport: r, Check: dyno + "|" + resultType + "|" + r.Dest}
+}
+
+func NewChecker(cfg config.Config, red redisclient.Store, privateTLS *tls.Config, node *gossip.Node, buffer *WriteBuffer) *Checker {
+	privateScheme := "http"
+	privateClient := http.DefaultClient
+	if privateTLS != nil {
+		privateScheme = "https"
+		privateClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: privateTLS},
+		}
+	}
 	return &Checker{
-		appName:          cfg.AppName,
-		dyno:             cfg.DynoID,
-		defaultNATCheck:  "https://www.google.com",
-		redis:            red,
-		checkPrivateCron: cfg.PrivateCheckCron,
-		checkDMZCron:     cfg.DMZCheckCron,
-		checkNATCron:     cfg.NATCheckCron,
+		appName:           cfg.AppName,
+		dyno:              cfg.DynoID,
+		keys:              keyspace(cfg.Namespace),
+		defaultNATCheck:   "https://www.google.com",
+		redis:             red,
+		checkPrivateCron:  cfg.PrivateCheckCron,
+		checkDMZCron:      cfg.DMZCheckCron,
+		checkNATCron:      cfg.NATCheckCron,
+		privateScheme:     privateScheme,
+		privateClient:     privateClient,
+		privateTLS:        privateTLS,
+		certWarnDays:      cfg.CertExpiryWarnDays,
+		targets:           cfg.Targets,
+		checkUDPCron:      cfg.UDPCheckCron,
+		udpPort:           cfg.UDPEchoPort,
+		udpBurstCount:     cfg.UDPBurstCount,
+		throughputCron:    cfg.ThroughputCron,
+		throughputBytes:   cfg.ThroughputBytes,
+		throughputTimeout: time.Duration(cfg.ThroughputSeconds) * time.Second,
+		throughputPort:    cfg.ThroughputPort,
+		checkLatencyCron:  cfg.LatencyCheckCron,
+		latencySamples:    cfg.LatencySamples,
+		checkDNSCron:      cfg.DNSCheckCron,
+		dnsResolvers:      cfg.DNSResolvers,
+		dnsNames:          cfg.DNSNames,
+		peerDiscovery:     cfg.PeerDiscovery,
+		peerDNSName:       cfg.PeerDNSName,
+		privateIP:         cfg.PrivateIP,
+		gossip:            node,
+		gossipPort:        cfg.GossipPort,
+		buffer:            buffer,
+		checkRedisCron:    cfg.RedisCheckCron,
+		redisLatencyWarn:  time.Duration(cfg.RedisLatencyWarnMS) * time.Millisecond,
+		staleAfter:        staleAfter(cfg),
+		clockSkewWarn:     time.Duration(cfg.ClockSkewWarnMS) * time.Millisecond,
 	}
 }
 
 func (c *Checker) Report(ctx context.Context) map[string]interface{} {
-	dynos := c.getDynos(ctx)
-
-	var reports []Report
-	for _, dyno := range dynos {
-		reports = append(reports, c.dynoReport(ctx, dyno))
+	if c.gossip != nil {
+		err := c.redis.Ping(ctx).Err()
+		if err != nil {
+			log.WithError(err).Warn("Redis unavailable, reporting from gossip state")
+			return c.gossipReport()
+		}
 	}
 
 	return map[string]interface{}{
-		"dynos": reports,
+		"dynos":      c.reports(ctx, c.localRead()),
+		"dns":        c.dnsConsistency(ctx),
+		"slo":        c.sloBreaches(ctx),
+		"membership": c.membership(ctx),
 	}
 }
 
-func (c *Checker) dynoReport(ctx context.Context, dynoID string) Report {
-	return Report{
-		Dyno:    dynoID,
-		DMZ:     c.dynoDMZReport(ctx, dynoID),
-		NAT:     c.dynoCheckReports(ctx, dynoID, "nat"),
-		Private: c.dynoCheckReports(ctx, dynoID, "private"),
+// ReadReport is the dynos part of Report for tools outside the app, like
+// cmd/netcheck.  It only reads, leaving expired dynos and results for the
+// app's dynos to tidy up, and fails rather than reporting no dynos when
+// redis can't be reached.
+func (c *Checker) ReadReport(ctx context.Context) ([]Report, error) {
+	err := c.redis.Ping(ctx).Err()
+	if err != nil {
+		return nil, err
 	}
+	return c.reports(ctx, readOptions{staleAfter: c.staleAfter}), nil
 }
 
-func (c *Checker) dynoDMZReport(ctx context.Context, dynoID string) []CheckReport {
-	result, err := c.redis.Get(ctx, "dmz:"+dynoID).Result()
-	if err != nil {
-		log.WithError(err).Error("Unable to get dmz check report")
-		return []CheckReport{}
-	}
-	return []CheckReport{{
-		Result: result,
-	}}
-}
-
-func (c *Checker) dynoCheckReports(ctx context.Context, dynoID string, checkType string) []CheckReport {
-	var reports []CheckReport
-	var cursor uint64 = 0
-	for {
-		var keys []string
-		var err error
-		keys, cursor, err = c.redis.Scan(ctx, cursor, c.checkKeyPrefix(checkType, dynoID)+":dest:*", 10).Result()
-		log.Infof("cursor: %v keys: %v", cursor, keys)
-		if err != nil {
-			log.WithError(err).Warn("Unable to fetch results from redis")
-			break
-		}
+// reports reads every dyno's report: the namespace's dynos, then one-off
+// dynos and any still on the version 1 layout.
+func (c *Checker) reports(ctx context.Context, opts readOptions) []Report {
+	dynos := c.readReports(ctx, c.keys, c.readDynos(ctx, c.keys, opts), opts)
+	dynos = append(dynos, c.oneOffReports(ctx, dynos, opts)...)
+	dynos = append(dynos, c.legacyReports(ctx, dynos, opts)...)
+	c.attachSparklines(ctx, dynos)
+	return dynos
+}
 
-		if len(keys) > 0 {
-			values, err := c.redis.MGet(ctx, keys...).Result()
-			if err != nil {
-				log.WithError(err).Warn("Unable to fetch results from redis")
-				break
-			}
-			for i, value := range values {
-				if value == nil {
-					continue
-				}
-				reports = append(reports, CheckReport{
-					Dest:   strings.TrimPrefix(keys[i], c.checkKeyPrefix(checkType, dynoID)+":dest:"),
-					Result: fmt.Sprintf("%v", value),
-				})
-			}
-		}
+func (c *Checker) CheckPrivate(ctx context.Context) {
+	dynos := c.getPeers(ctx)
+	for _, dyno := range dynos {
+		target := config.Target{URL: fmt.Sprintf("%v://%v:7777/private", c.privateScheme, dyno)}
+		c.checkTarget(ctx, target, target.URL, "private", c.privateClient)
+	}
+}
 
-		if cursor == 0 {
-			break
-		}
+// udpProbeConcurrency bounds how many peers CheckUDP probes at once.  Each
+// probe spends most of its time waiting on echoes, so they overlap well.
+const udpProbeConcurrency = 16
+
+func (c *Checker) CheckUDP(ctx context.Context) {
+	dynos := c.getPeers(ctx)
+	sem := make(chan struct{}, udpProbeConcurrency)
+	var wg sync.WaitGroup
+	for _, dyno := range dynos {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(dyno string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			stats, err := probeUDP(ctx, net.JoinHostPort(dyno, c.udpPort), c.udpBurstCount, 10*time.Millisecond, 2*time.Second)
+			result := udpResult(stats, err)
+			log.WithFields(log.Fields{
+				"fn":     "Reporter.CheckUDP",
+				"dyno":   dyno,
+				"result": result,
+			}).Info()
+			c.storeResult(ctx, "udp", dyno, result)
+		}(dyno)
 	}
-	return reports
+	wg.Wait()
 }
 
-func (c *Checker) CheckPrivate(ctx context.Context) {
-	dynos := c.getDynos(ctx)
+func (c *Checker) CheckLatency(ctx context.Context) {
+	dynos := c.getPeers(ctx)
 	for _, dyno := range dynos {
-		c.CheckURL(ctx, fmt.Sprintf("http://%v:7777/private", dyno), "private")
+		stats, err := probeTCPLatency(ctx, net.JoinHostPort(dyno, "7777"), c.privateTLS, c.latencySamples, 3*time.Second)
+		result := latencyResult(stats, err)
+		log.WithFields(log.Fields{
+			"fn":     "Reporter.CheckLatency",
+			"dyno":   dyno,
+			"result": result,
+		}).Info()
+		c.storeResult(ctx, "latency", dyno, result)
+		if err == nil {
+			err = c.recordLatencyHistory(ctx, dyno, stats)
+			if err != nil {
+				log.WithError(err).Error("Unable to record latency history")
+			}
+		}
 	}
 }
 
 func (c *Checker) CheckNAT(ctx context.Context) {
+	for _, target := range c.targets {
+		for _, mode := range target.ConnectionModes() {
+			client := http.DefaultClient
+			if mode == config.ConnectionFresh {
+				client = freshClient(client)
+			}
+			c.checkTarget(ctx, target, modeDest(target, mode), "nat", client)
+		}
+	}
+
 	url, err := c.getExternalURL(ctx)
 	if err != nil || url == "" {
 		return
@@ -140,74 +284,159 @@ func (c *Checker) CheckDMZ(ctx context.Context) {
 	c.CheckURL(ctx, c.getDMZURL(), "dmz")
 }
 
-func (c *Checker) checkKey(resultType string, url string) string {
-	return fmt.Sprintf("%v:dest:%v", c.checkKeyPrefix(resultType, c.dyno), url)
-}
-
-func (c *Checker) checkKeyPrefix(resultType string, dynoId string) string {
-	return fmt.Sprintf("%v:src:%v", resultType, dynoId)
+func (c *Checker) CheckURL(ctx context.Context, url string, resultType string) error {
+	return c.checkTarget(ctx, config.Target{URL: url}, url, resultType, http.DefaultClient)
 }
 
-func (c *Checker) CheckURL(ctx context.Context, url string, resultType string) error {
+func (c *Checker) checkTarget(ctx context.Context, target config.Target, dest string, resultType string, client *http.Client) error {
 	logger := log.WithFields(log.Fields{
 		"fn":   "Reporter.CheckURL",
-		"url":  url,
+		"url":  target.URL,
+		"dest": dest,
 		"type": resultType,
 	})
 
 	logger.Info()
 
-	err := requests.URL(url).Method(http.MethodGet).Fetch(ctx)
+	if target.Type == config.TargetScript {
+		return c.checkScript(ctx, target, dest, resultType, client)
+	}
+
+	tlsState, err := fetchTarget(ctx, target, client)
 	var result string
 	if err != nil {
-		result = fmt.Sprintf("fail:%v:%v", err, timeTag())
+		result = failResult(err)
 	} else {
 		result = fmt.Sprintf("pass:%v", timeTag())
 	}
 	logger.WithField("result", result).Info()
 
-	_, err = c.redis.Set(ctx, c.checkKey(resultType, url), result, 10*time.Minute).Result()
+	if info, ok := peerCertInfo(tlsState); ok {
+		expiry := certResult(info, c.certWarnDays, time.Now())
+		logger.WithField("cert", expiry).Info()
+		c.storeResult(ctx, "cert", target.Dest(), expiry)
+	}
+
+	return c.storeResult(ctx, resultType, dest, result)
+}
+
+func (c *Checker) checkScript(ctx context.Context, target config.Target, dest string, resultType string, client *http.Client) error {
+	timings, err := runScript(ctx, target, client)
+	var result string
 	if err != nil {
-		logger.WithError(err).Error("Unable to set check result")
-		return err
+		result = failResult(fmt.Errorf("%w (%v)", err, formatTimings(timings)))
+	} else {
+		result = fmt.Sprintf("pass:%v:%v", formatTimings(timings), timeTag())
 	}
-	return nil
+	log.WithFields(log.Fields{
+		"fn":     "Reporter.checkScript",
+		"dest":   dest,
+		"type":   resultType,
+		"result": result,
+	}).Info()
+
+	return c.storeResult(ctx, resultType, dest, result)
 }
 
-func (c *Checker) getDynos(ctx context.Context) []string {
-	dynos := make([]string, 0)
+func fetchTarget(ctx context.Context, target config.Target, client *http.Client) (*tls.ConnectionState, error) {
+	method := target.Method
+	if method == "" {
+		method = http.MethodGet
+	}
 
-	var cursor uint64 = 0
-	for {
-		var keys []string
-		var err error
-		keys, cursor, err = c.redis.Scan(ctx, cursor, "liveness:*", 10).Result()
-		if err != nil {
-			log.WithError(err).Warn("Unable to fetch dynos from redis")
-			break
-		}
-		for _, key := range keys {
-			dynos = append(dynos, strings.TrimPrefix(key, "liveness:"))
-		}
+	var tlsState *tls.ConnectionState
+	rb := requests.URL(target.URL).
+		Method(method).
+		Client(client).
+		AddValidator(func(res *http.Response) error {
+			tlsState = res.TLS
+			return checkStatus(target.Assert, res)
+		}).
+		AddValidator(func(res *http.Response) error {
+			return checkHeaders(target.Assert, res)
+		})
+	for name, value := range target.Headers {
+		rb.Header(name, value)
+	}
+	if target.Body != "" {
+		rb.BodyBytes([]byte(target.Body))
+	}
+	if hasBodyAssertions(target.Assert) {
+		rb.Handle(func(res *http.Response) error {
+			body, err := readBody(target.Assert, res)
+			if err != nil {
+				return err
+			}
+			return checkBody(target.Assert, body)
+		})
+	}
 
-		if cursor == 0 {
-			break
+	err := rb.Fetch(ctx)
+	if tlsState == nil && certificateError(err) {
+		var inspectErr error
+		tlsState, inspectErr = inspectPeerChain(ctx, target.URL)
+		if inspectErr != nil {
+			log.WithError(inspectErr).WithField("url", target.URL).Warn("Unable to inspect rejected certificate chain")
 		}
 	}
+	return tlsState, err
+}
 
-	return dynos
+func (c *Checker) storeResult(ctx context.Context, resultType string, dest string, result string) error {
+	if c.gossip != nil {
+		c.gossip.SetResult(gossipKey(resultType, dest), result)
+	}
+
+	err := c.buffer.SetResult(ctx, c.keys.checkKey(resultType, c.dyno, dest), result, 10*time.Minute,
+		resultsIndexMember(resultType, dest))
+	if err != nil {
+		log.WithError(err).WithFields(log.Fields{
+			"type": resultType,
+			"dest": dest,
+		}).Error("Unable to set check result")
+		return err
+	}
+	publishEvent(ctx, c.redis, c.keys, resultEvent(c.dyno, resultType, dest, result))
+	return nil
 }
 
-func (c *Checker) getDMZURL() string {
-	return fmt.Sprintf("https://%v.herokuapp.com/dmz", c.appName)
+func failResult(err error) string {
+	if class := failureClass(err); class != "" {
+		return fmt.Sprintf("fail:%v:%v:%v", class, err, timeTag())
+	}
+	return fmt.Sprintf("fail:%v:%v", err, timeTag())
 }
 
-func (l *Checker) dmzReportKey() string {
-	return fmt.Sprintf("dmz:%v", l.dyno)
+// failureClass groups errors so the report can say why a check failed, e.g.
+// a peer presenting a certificate for the wrong identity is distinguishable
+// from one we couldn't verify at all.
+func failureClass(err error) string {
+	var assertionErr *AssertionError
+	if errors.As(err, &assertionErr) {
+		return "assertion"
+	}
+	var dnsErr *net.DNSError
+	var rcodeErr *dns.RcodeError
+	if errors.As(err, &dnsErr) || errors.As(err, &rcodeErr) {
+		return "dns"
+	}
+	var hostnameErr x509.HostnameError
+	if errors.As(err, &hostnameErr) {
+		return "identity"
+	}
+	var recordErr tls.RecordHeaderError
+	if certificateError(err) || errors.As(err, &recordErr) {
+		return "tls"
+	}
+	return ""
+}
+
+func (c *Checker) getDMZURL() string {
+	return fmt.Sprintf("https://%v.herokuapp.com/dmz", c.appName)
 }
 
 func (c *Checker) getExternalURL(ctx context.Context) (string, error) {
-	url, err := c.redis.Get(ctx, "settings:NATCheckURL").Result()
+	url, err := c.redis.Get(ctx, c.keys.natCheckURLKey()).Result()
 	if err != nil {
 		log.WithError(err).Error("Unable to fetch NATCheckURL from Redis")
 		return "", err
@@ -224,6 +453,18 @@ func (c *Checker) Start() {
 	_, err := crn.AddFunc(c.checkPrivateCron, func() { c.CheckPrivate(context.Background()) })
 	_, err = crn.AddFunc(c.checkNATCron, func() { c.CheckNAT(context.Background()) })
 	_, err = crn.AddFunc(c.checkDMZCron, func() { c.CheckDMZ(context.Background()) })
+	// A burst per peer can still outlast the schedule on a big enough
+	// fleet, so a run still going skips the next rather than piling up.
+	_, err = crn.AddJob(c.checkUDPCron, cron.NewChain(cron.SkipIfStillRunning(cron.DefaultLogger)).
+		Then(cron.FuncJob(func() { c.CheckUDP(context.Background()) })))
+	_, err = crn.AddFunc(c.checkLatencyCron, func() { c.CheckLatency(context.Background()) })
+	_, err = crn.AddFunc(c.checkRedisCron, func() { c.CheckRedis(context.Background()) })
+	if len(c.dnsResolvers) > 0 {
+		_, err = crn.AddFunc(c.checkDNSCron, func() { c.CheckDNS(context.Background()) })
+	}
+	if c.throughputCron != "" {
+		_, err = crn.AddFunc(c.throughputCron, func() { c.checkThroughputAll(context.Background()) })
+	}
 	if err != nil {
 		log.WithError(err).Error("Unable to start checker crons")
 	}
@@ -0,0 +1,119 @@
+package liveness
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/archa347/ps-network-test/ntp"
+	redisclient "github.com/archa347/ps-network-test/redis"
+	"time"
+)
+
+// ntpInterval keeps NTP queries well under what public pools tolerate, while
+// the redis offset is measured with every heartbeat.
+const ntpInterval = time.Minute
+
+// ClockOffset is how far a dyno's clock is behind redis, and optionally an
+// NTP server: add it to the dyno's local time to get the reference time.
+type ClockOffset struct {
+	Redis     time.Duration
+	RedisRTT  time.Duration
+	NTP       time.Duration
+	NTPServer string `json:",omitempty"`
+	NTPError  string `json:",omitempty"`
+	Measured  time.Time
+	Skewed    bool
+}
+
+// redisOffset compares local time with redis TIME, assuming the reply was
+// generated halfway through the round trip.
+func redisOffset(ctx context.Context, client redisclient.Store) (time.Duration, time.Duration, error) {
+	start := time.Now()
+	reference, err := client.Time(ctx).Result()
+	rtt := time.Since(start)
+	if err != nil {
+		return 0, 0, err
+	}
+	return reference.Sub(start.Add(rtt / 2)), rtt, nil
+}
+
+func abs(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// reportClock measures this dyno's clock offset and stores it for as long
+// as the heartbeat.
+func (l *Reporter) reportClock(ctx context.Context) error {
+	offset, rtt, err := redisOffset(ctx, l.redis)
+	if err != nil {
+		return err
+	}
+	clock := ClockOffset{
+		Redis:    offset.Round(time.Microsecond),
+		RedisRTT: rtt.Round(time.Microsecond),
+		Measured: time.Now(),
+	}
+
+	if l.ntpServer != "" {
+		l.ntpMu.Lock()
+		clock.NTP = l.ntp.NTP
+		clock.NTPServer = l.ntp.NTPServer
+		clock.NTPError = l.ntp.NTPError
+		l.ntpMu.Unlock()
+	}
+
+	data, err := json.Marshal(clock)
+	if err != nil {
+		return err
+	}
+	return l.redis.Set(ctx, l.keys.clockKey(l.dyno), data, time.Minute).Err()
+}
+
+// measureNTP queries the NTP server every ntpInterval, apart from the
+// heartbeat so a slow server can't hold it up.  reportClock sends the latest
+// measurement with each heartbeat.
+func (l *Reporter) measureNTP() {
+	for {
+		measured := ClockOffset{NTPServer: l.ntpServer, Measured: time.Now()}
+		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+		resp, err := ntp.Query(ctx, l.ntpServer)
+		cancel()
+		if err != nil {
+			measured.NTPError = err.Error()
+		} else {
+			measured.NTP = resp.Offset.Round(time.Microsecond)
+		}
+
+		l.ntpMu.Lock()
+		l.ntp = measured
+		l.ntpMu.Unlock()
+		time.Sleep(ntpInterval)
+	}
+}
+
+func (c *Checker) decodeClock(value string) *ClockOffset {
+	var clock ClockOffset
+	if value == "" || json.Unmarshal([]byte(value), &clock) != nil {
+		return nil
+	}
+	clock.Skewed = abs(clock.Redis) > c.clockSkewWarn ||
+		(clock.NTPServer != "" && clock.NTPError == "" && abs(clock.NTP) > c.clockSkewWarn)
+	return &clock
+}
+
+// normalizeResult rewrites a result's time tag from the source dyno's clock
+// to redis's, so results from different dynos can be compared.  Tags only
+// have second precision, so smaller offsets are left alone.
+func normalizeResult(check *CheckReport, offset time.Duration) {
+	if offset.Round(time.Second) == 0 {
+		return
+	}
+	t, ok := resultTime(check.Result)
+	if !ok {
+		return
+	}
+	tag := resultTimePattern.FindStringIndex(check.Result)
+	check.Result = check.Result[:tag[0]] + t.Add(offset).Format(time.RFC3339)
+}
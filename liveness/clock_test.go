@@ -0,0 +1,62 @@
+package liveness
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/archa347/ps-network-test/config"
+	"testing"
+	"time"
+)
+
+// skewedClock records dyno's clock as behind redis by offset.
+func skewedClock(t *testing.T, checker *Checker, dyno string, offset time.Duration) {
+	data, _ := json.Marshal(ClockOffset{Redis: offset, Measured: time.Now()})
+	err := checker.redis.Set(context.Background(), checker.keys.clockKey(dyno), data, time.Minute).Err()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResultEventsAreNormalized(t *testing.T) {
+	_, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	stream := NewEventStream(config.Config{Namespace: "myapp"}, client)
+	ctx := context.Background()
+
+	skewedClock(t, checker, "web.2", 10*time.Minute)
+	now := time.Now().Truncate(time.Second)
+	event := resultEvent("web.2", "udp", "web.1", "pass:"+now.Add(-10*time.Minute).Format(time.RFC3339))
+	stream.normalize(ctx, &event)
+	if want := "pass:" + now.Format(time.RFC3339); event.Result != want {
+		t.Errorf("result = %v, want %v", event.Result, want)
+	}
+
+	membership := membershipEvent("web.2", "joined")
+	stream.normalize(ctx, &membership)
+	if membership.Result != "" {
+		t.Errorf("membership event given a result %q", membership.Result)
+	}
+}
+
+func TestSilentDynosUseNormalizedTimes(t *testing.T) {
+	_, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	aggregator := NewAggregator(config.Config{DynoID: "web.1", Namespace: "myapp"}, client, checker)
+	ctx := context.Background()
+
+	// web.2's clock is ten minutes slow, so its last result looks old until
+	// it's moved onto redis's clock.  web.3 really has gone quiet.
+	now := time.Now()
+	skewedClock(t, checker, "web.2", 10*time.Minute)
+	client.Set(ctx, checker.keys.lastResultKey("web.2"), now.Add(-10*time.Minute).Format(time.RFC3339), time.Hour)
+	client.Set(ctx, checker.keys.lastResultKey("web.3"), now.Add(-10*time.Minute).Format(time.RFC3339), time.Hour)
+
+	reports := checker.dynoReports(ctx, checker.keys, []string{"web.2", "web.3"})
+	silent := aggregator.silentDynos(ctx, reports, now)
+	if _, ok := silent["web.2"]; ok {
+		t.Errorf("web.2 reported silent despite its clock offset: %v", silent["web.2"])
+	}
+	if _, ok := silent["web.3"]; !ok {
+		t.Errorf("web.3 not reported silent: %v", silent)
+	}
+}
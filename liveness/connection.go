@@ -0,0 +1,34 @@
+package liveness
+
+import (
+	"github.com/archa347/ps-network-test/config"
+	"net/http"
+)
+
+// freshClient returns a copy of base whose only connection is made for this
+// check: keep-alives are off, so every request dials a new TCP (and TLS)
+// connection and looks the host up again, and failures that long-lived pooled
+// connections hide still show up.  Everything else, like the proxy and TLS
+// settings, is base's, so the two modes take the same path.
+func freshClient(base *http.Client) *http.Client {
+	if base == nil {
+		base = http.DefaultClient
+	}
+	transport := http.DefaultTransport.(*http.Transport)
+	if t, ok := base.Transport.(*http.Transport); ok {
+		transport = t
+	}
+	fresh := transport.Clone()
+	fresh.DisableKeepAlives = true
+
+	client := *base
+	client.Transport = fresh
+	return &client
+}
+
+func modeDest(target config.Target, mode string) string {
+	if len(target.ConnectionModes()) == 1 {
+		return target.Dest()
+	}
+	return target.Dest() + " (" + mode + ")"
+}
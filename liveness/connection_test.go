@@ -0,0 +1,63 @@
+package liveness
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestFreshClientKeepsBaseSettings(t *testing.T) {
+	// The proxy answers for any host, the way HTTP(S)_PROXY routes checks.
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.String())
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	tlsConfig := &tls.Config{ServerName: "internal"}
+	base := &http.Client{
+		Timeout:   7 * time.Second,
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL), TLSClientConfig: tlsConfig},
+	}
+	fresh := freshClient(base)
+
+	for i := 0; i < 2; i++ {
+		res, err := fresh.Get("http://target.invalid/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	if len(proxied) != 2 || proxied[0] != "http://target.invalid/health" {
+		t.Errorf("proxy saw %v, want both requests", proxied)
+	}
+
+	transport := fresh.Transport.(*http.Transport)
+	if !transport.DisableKeepAlives {
+		t.Error("fresh client keeps connections alive")
+	}
+	if transport.TLSClientConfig.ServerName != "internal" {
+		t.Errorf("TLS config not carried over: %+v", transport.TLSClientConfig)
+	}
+	if fresh.Timeout != base.Timeout {
+		t.Errorf("timeout = %v, want %v", fresh.Timeout, base.Timeout)
+	}
+	if base.Transport.(*http.Transport).DisableKeepAlives {
+		t.Error("base client's transport was modified")
+	}
+}
+
+func TestFreshClientDefaults(t *testing.T) {
+	fresh := freshClient(http.DefaultClient)
+	transport, ok := fresh.Transport.(*http.Transport)
+	if !ok || !transport.DisableKeepAlives || transport.Proxy == nil {
+		t.Errorf("fresh default transport = %+v, want the default transport without keep-alives", fresh.Transport)
+	}
+	if http.DefaultTransport.(*http.Transport).DisableKeepAlives {
+		t.Error("default transport was modified")
+	}
+}
@@ -0,0 +1,88 @@
+package liveness
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+)
+
+const (
+	DiscoveryRedis = "redis"
+	DiscoveryDNS   = "dns"
+)
+
+type Membership struct {
+	DNSName string
+	// InDNSOnly are addresses the space's DNS name resolves to that no
+	// heartbeating dyno resolves to.
+	InDNSOnly []string
+	// InRedisOnly are heartbeating dynos whose addresses aren't in DNS.
+	InRedisOnly []string
+	Error       string
+}
+
+func (m Membership) Consistent() bool {
+	return m.Error == "" && len(m.InDNSOnly) == 0 && len(m.InRedisOnly) == 0
+}
+
+// getPeers returns the hosts to probe, either the dyno names heartbeating in
+// redis or the addresses behind the process type's DNS name.  DNS peers are
+// plain IPs, which is why config rejects DNS discovery with private TLS.
+func (c *Checker) getPeers(ctx context.Context) []string {
+	if c.peerDiscovery != DiscoveryDNS {
+		dynos := c.getDynos(ctx, c.keys)
+		if c.unmigrated(ctx) {
+			dynos = append(dynos, c.unmigratedDynos(ctx, dynos, c.localRead())...)
+			sort.Strings(dynos)
+		}
+		return dynos
+	}
+	addrs, err := net.DefaultResolver.LookupHost(ctx, c.peerDNSName)
+	if err != nil {
+		log.WithError(err).WithField("name", c.peerDNSName).Warn("Unable to discover peers from DNS")
+		return []string{}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func (c *Checker) membership(ctx context.Context) *Membership {
+	if c.peerDNSName == "" {
+		return nil
+	}
+	m := &Membership{DNSName: c.peerDNSName}
+
+	dnsAddrs, err := net.DefaultResolver.LookupHost(ctx, c.peerDNSName)
+	if err != nil {
+		m.Error = err.Error()
+		return m
+	}
+	inDNS := make(map[string]bool)
+	for _, addr := range dnsAddrs {
+		inDNS[addr] = true
+	}
+
+	heartbeating := make(map[string]bool)
+	for _, dyno := range c.getDynos(ctx, c.keys) {
+		addrs, err := net.DefaultResolver.LookupHost(ctx, dyno)
+		found := false
+		if err == nil {
+			for _, addr := range addrs {
+				heartbeating[addr] = true
+				found = found || inDNS[addr]
+			}
+		}
+		if !found {
+			m.InRedisOnly = append(m.InRedisOnly, dyno)
+		}
+	}
+	for _, addr := range dnsAddrs {
+		if !heartbeating[addr] {
+			m.InDNSOnly = append(m.InDNSOnly, addr)
+		}
+	}
+	sort.Strings(m.InDNSOnly)
+	sort.Strings(m.InRedisOnly)
+	return m
+}
@@ -0,0 +1,207 @@
+package liveness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/archa347/ps-network-test/dns"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var dnsNetworks = []string{"udp", "tcp"}
+
+// dnsAnswerTTL is how long a source's answer counts towards consistency.
+// Sources share a hash per name, so each answer carries its own write time
+// rather than relying on the key's TTL, which every write refreshes.
+const dnsAnswerTTL = 10 * time.Minute
+
+type DNSConsistency struct {
+	Name       string
+	Answers    []DNSAnswerGroup
+	Consistent bool
+}
+
+type DNSAnswerGroup struct {
+	Answer  string
+	Sources []string
+}
+
+// CheckDNS asks every configured resolver, over both UDP and TCP, for the A
+// records of the configured names and of every live dyno.
+func (c *Checker) CheckDNS(ctx context.Context) {
+	names := append(append([]string{}, c.dnsNames...), c.getDynos(ctx, c.keys)...)
+	for _, name := range names {
+		for _, resolver := range c.dnsResolvers {
+			for _, network := range dnsNetworks {
+				c.checkDNS(ctx, name, resolver, network)
+			}
+		}
+	}
+}
+
+func (c *Checker) checkDNS(ctx context.Context, name string, resolver string, network string) {
+	result, answer, _ := queryDNS(ctx, name, resolver, network)
+
+	source := fmt.Sprintf("%v@%v/%v", c.dyno, resolver, network)
+	log.WithFields(log.Fields{
+		"fn":     "Reporter.CheckDNS",
+		"name":   name,
+		"source": source,
+		"result": result,
+	}).Info()
+
+	c.storeResult(ctx, "dns", fmt.Sprintf("%v@%v/%v", name, resolver, network), result)
+
+	key := c.keys.dnsAnswersKey(name)
+	pipe := c.redis.TxPipeline()
+	pipe.HSet(ctx, key, source, fmt.Sprintf("%v|%v", time.Now().Unix(), answer))
+	pipe.Expire(ctx, key, dnsAnswerTTL)
+	_, err := pipe.Exec(ctx)
+	if err == nil {
+		err = c.redis.SAdd(ctx, c.keys.dnsNamesKey(), name).Err()
+	}
+	if err != nil {
+		log.WithError(err).Error("Unable to record DNS answers")
+	}
+}
+
+// queryDNS looks up name's A records, returning the check result and the
+// answer to compare with other dynos and resolvers.
+func queryDNS(ctx context.Context, name string, resolver string, network string) (string, string, error) {
+	queryCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	answers, err := dns.Query(queryCtx, resolver, network, name, dns.TypeA)
+	elapsed := time.Since(start).Round(time.Microsecond)
+
+	var addresses []string
+	for _, answer := range answers {
+		if answer.Type == dns.TypeA {
+			addresses = append(addresses, answer.Value)
+		}
+	}
+	sort.Strings(addresses)
+	answer := strings.Join(addresses, ",")
+
+	var result string
+	switch {
+	case err != nil:
+		result = failResult(fmt.Errorf("%w (%v)", err, elapsed))
+		answer = "error: " + dnsErrorAnswer(err)
+	case len(addresses) == 0:
+		result = fmt.Sprintf("fail:empty:no A records (%v):%v", elapsed, timeTag())
+		answer = "empty"
+	default:
+		result = fmt.Sprintf("pass:%v (%v):%v", answer, elapsed, timeTag())
+	}
+	return result, answer, err
+}
+
+// dnsErrorAnswer describes a failed query without the socket addresses net
+// errors carry, so the same failure from different dynos groups together.
+func dnsErrorAnswer(err error) string {
+	var rcodeErr *dns.RcodeError
+	var netErr net.Error
+	var opErr *net.OpError
+	switch {
+	case errors.As(err, &rcodeErr):
+		return rcodeErr.Error()
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr):
+		return opErr.Err.Error()
+	}
+	return err.Error()
+}
+
+// dnsConsistency groups every dyno and resolver's latest answer for each name,
+// so a name that resolves differently depending on who asks stands out.
+func (c *Checker) dnsConsistency(ctx context.Context) []DNSConsistency {
+	var reports []DNSConsistency
+	names, err := c.redis.SMembers(ctx, c.keys.dnsNamesKey()).Result()
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch DNS answers from redis")
+		return reports
+	}
+
+	// The answer hashes live in different slots, so this can't be a
+	// transaction, but a plain pipeline is still one round trip.
+	pipe := c.redis.Pipeline()
+	answers := make([]*redis.StringStringMapCmd, len(names))
+	for i, name := range names {
+		answers[i] = pipe.HGetAll(ctx, c.keys.dnsAnswersKey(name))
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch DNS answers from redis")
+	}
+
+	var expired []interface{}
+	cleanup := c.redis.Pipeline()
+	for i, name := range names {
+		sources, stale := freshDNSAnswers(answers[i].Val(), time.Now())
+		if len(stale) > 0 {
+			cleanup.HDel(ctx, c.keys.dnsAnswersKey(name), stale...)
+		}
+		if len(sources) == 0 {
+			if answers[i].Err() == nil {
+				expired = append(expired, name)
+			}
+			continue
+		}
+		reports = append(reports, groupDNSAnswers(name, sources))
+	}
+	if len(expired) > 0 {
+		cleanup.SRem(ctx, c.keys.dnsNamesKey(), expired...)
+	}
+	if cleanup.Len() > 0 {
+		_, err = cleanup.Exec(ctx)
+		if err != nil {
+			log.WithError(err).Warn("Unable to prune stale DNS answers")
+		}
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports
+}
+
+// freshDNSAnswers splits a name's stored answers into those written within
+// dnsAnswerTTL, keyed by source, and the sources to prune, such as dynos that
+// have since gone away.
+func freshDNSAnswers(fields map[string]string, now time.Time) (map[string]string, []string) {
+	fresh := make(map[string]string)
+	var stale []string
+	for source, value := range fields {
+		written, answer, ok := strings.Cut(value, "|")
+		unix, err := strconv.ParseInt(written, 10, 64)
+		if !ok || err != nil || now.Sub(time.Unix(unix, 0)) > dnsAnswerTTL {
+			stale = append(stale, source)
+			continue
+		}
+		fresh[source] = answer
+	}
+	return fresh, stale
+}
+
+func groupDNSAnswers(name string, sources map[string]string) DNSConsistency {
+	grouped := make(map[string][]string)
+	for source, answer := range sources {
+		grouped[answer] = append(grouped[answer], source)
+	}
+	report := DNSConsistency{Name: name}
+	for answer, sources := range grouped {
+		sort.Strings(sources)
+		report.Answers = append(report.Answers, DNSAnswerGroup{Answer: answer, Sources: sources})
+	}
+	sort.Slice(report.Answers, func(i, j int) bool { return report.Answers[i].Answer < report.Answers[j].Answer })
+	report.Consistent = len(report.Answers) == 1 &&
+		report.Answers[0].Answer != "empty" &&
+		!strings.HasPrefix(report.Answers[0].Answer, "error: ")
+	return report
+}
@@ -0,0 +1,77 @@
+package liveness
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreshDNSAnswers(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	fields := map[string]string{
+		"web.1@10.0.0.2:53/udp": fmt.Sprintf("%v|10.0.1.5", now.Add(-time.Minute).Unix()),
+		"web.2@10.0.0.2:53/udp": fmt.Sprintf("%v|10.0.1.5", now.Add(-dnsAnswerTTL-time.Second).Unix()),
+		"web.3@10.0.0.2:53/udp": "10.0.1.5",
+	}
+
+	fresh, stale := freshDNSAnswers(fields, now)
+	if len(fresh) != 1 || fresh["web.1@10.0.0.2:53/udp"] != "10.0.1.5" {
+		t.Errorf("fresh = %v, want only web.1", fresh)
+	}
+	if len(stale) != 2 {
+		t.Errorf("stale = %v, want web.2 and web.3", stale)
+	}
+}
+
+func TestGroupDNSAnswers(t *testing.T) {
+	consistent := groupDNSAnswers("api.internal", map[string]string{
+		"web.1@a/udp": "10.0.0.1,10.0.0.2",
+		"web.2@a/tcp": "10.0.0.1,10.0.0.2",
+	})
+	if !consistent.Consistent || len(consistent.Answers[0].Sources) != 2 {
+		t.Errorf("matching answers reported as %+v", consistent)
+	}
+
+	split := groupDNSAnswers("api.internal", map[string]string{
+		"web.1@a/udp": "10.0.0.1",
+		"web.2@a/udp": "10.0.0.2",
+	})
+	if split.Consistent || len(split.Answers) != 2 {
+		t.Errorf("differing answers reported as %+v", split)
+	}
+
+	failing := groupDNSAnswers("api.internal", map[string]string{
+		"web.1@a/udp": "error: timeout",
+		"web.2@a/udp": "error: timeout",
+	})
+	if failing.Consistent {
+		t.Errorf("agreeing errors reported as consistent")
+	}
+}
+
+func TestQueryDNSErrorsGroupAcrossSockets(t *testing.T) {
+	// Two silent resolvers time out from different local sockets, which
+	// must still produce the same answer to group on.
+	var answers []string
+	for i := 0; i < 2; i++ {
+		silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer silent.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		result, answer, err := queryDNS(ctx, "example.com", silent.LocalAddr().String(), "udp")
+		cancel()
+		if err == nil || !strings.HasPrefix(result, "fail:") {
+			t.Fatalf("result = %v, want a failure", result)
+		}
+		answers = append(answers, answer)
+	}
+	if answers[0] != "error: timeout" || answers[0] != answers[1] {
+		t.Errorf("answers = %q, want matching timeouts", answers)
+	}
+}
@@ -0,0 +1,149 @@
+package liveness
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/archa347/ps-network-test/config"
+	redisclient "github.com/archa347/ps-network-test/redis"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+// Event is a change to the report: a new result, or a dyno joining or
+// leaving.
+type Event struct {
+	Type     string
+	Dyno     string
+	Category string `json:",omitempty"`
+	Dest     string `json:",omitempty"`
+	Result   string `json:",omitempty"`
+	State    string `json:",omitempty"`
+	Change   string `json:",omitempty"`
+}
+
+func resultEvent(dyno string, resultType string, dest string, result string) Event {
+	check := CheckReport{Result: result}
+	return Event{
+		Type:     "result",
+		Dyno:     dyno,
+		Category: resultType,
+		Dest:     dest,
+		Result:   result,
+		State:    check.State(),
+	}
+}
+
+func membershipEvent(dyno string, change string) Event {
+	return Event{Type: "membership", Dyno: dyno, Change: change}
+}
+
+// publishEvent is best effort: a missed event only means a live page is
+// stale until it's reloaded.
+func publishEvent(ctx context.Context, client redisclient.Store, keys keyspace, event Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	err = client.Publish(ctx, keys.eventsChannel(), data).Err()
+	if err != nil {
+		log.WithError(err).WithField("event", event.Type).Debug("Unable to publish event")
+	}
+}
+
+// EventStream relays events published by every dyno to the report pages
+// this dyno is serving, over one subscription.
+type EventStream struct {
+	redis redisclient.Store
+	keys  keyspace
+
+	// offsets caches each publishing dyno's clock offset.  Only the
+	// subscription goroutine touches it.
+	offsets map[string]cachedOffset
+
+	mu      sync.Mutex
+	clients map[chan Event]bool
+}
+
+func NewEventStream(cfg config.Config, client redisclient.Store) *EventStream {
+	return &EventStream{
+		redis:   client,
+		keys:    keyspace(cfg.Namespace),
+		clients: make(map[chan Event]bool),
+		offsets: make(map[string]cachedOffset),
+	}
+}
+
+// Start subscribes to the events channel.  The subscription reconnects by
+// itself if redis goes away.
+func (s *EventStream) Start() {
+	pubsub := s.redis.Subscribe(context.Background(), s.keys.eventsChannel())
+	go func() {
+		for msg := range pubsub.Channel() {
+			var event Event
+			err := json.Unmarshal([]byte(msg.Payload), &event)
+			if err != nil {
+				log.WithError(err).Warn("Unable to decode event")
+				continue
+			}
+			s.normalize(context.Background(), &event)
+			s.broadcast(event)
+		}
+	}()
+}
+
+// offsetCacheTTL is how long a dyno's clock offset is reused for its events.
+// The offset is only stored for a minute, so it's refreshed well within that.
+const offsetCacheTTL = 30 * time.Second
+
+type cachedOffset struct {
+	offset  time.Duration
+	fetched time.Time
+}
+
+// normalize moves a result event's time tag onto redis's clock with its
+// dyno's offset, as the report does, so live updates and the report agree.
+func (s *EventStream) normalize(ctx context.Context, event *Event) {
+	if event.Type != "result" {
+		return
+	}
+	cached, ok := s.offsets[event.Dyno]
+	if !ok || time.Since(cached.fetched) > offsetCacheTTL {
+		cached = cachedOffset{fetched: time.Now()}
+		var clock ClockOffset
+		value, err := s.redis.Get(ctx, s.keys.clockKey(event.Dyno)).Result()
+		if err == nil && json.Unmarshal([]byte(value), &clock) == nil {
+			cached.offset = clock.Redis
+		}
+		s.offsets[event.Dyno] = cached
+	}
+	check := CheckReport{Result: event.Result}
+	normalizeResult(&check, cached.offset)
+	event.Result = check.Result
+}
+
+// broadcast drops events for clients that aren't keeping up rather than
+// holding up everyone else.
+func (s *EventStream) broadcast(event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ch := range s.clients {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel of events and a func to stop receiving them.
+func (s *EventStream) Subscribe() (<-chan Event, func()) {
+	ch := make(chan Event, 64)
+	s.mu.Lock()
+	s.clients[ch] = true
+	s.mu.Unlock()
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.clients, ch)
+		s.mu.Unlock()
+	}
+}
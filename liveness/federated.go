@@ -0,0 +1,109 @@
+package liveness
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"sort"
+)
+
+type NamespaceSummary struct {
+	Namespace string
+	Current   bool
+	Dynos     int
+	Passed    int
+	Warned    int
+	Stale     int
+	Failed    int
+	Failing   []FailingCheck
+}
+
+type FailingCheck struct {
+	Dyno   string
+	Dest   string
+	Result string
+}
+
+func (s *NamespaceSummary) Healthy() bool {
+	return s.Dynos > 0 && s.Failed == 0
+}
+
+type Category struct {
+	Name   string
+	Checks []CheckReport
+}
+
+// Categories lists a report's checks by the type they're stored under, in
+// the order the report page shows them.
+func (r *Report) Categories() []Category {
+	return []Category{
+		{Name: "dmz", Checks: r.DMZ},
+		{Name: "nat", Checks: r.NAT},
+		{Name: "private", Checks: r.Private},
+		{Name: "dns", Checks: r.DNS},
+		{Name: "latency", Checks: r.Latency},
+		{Name: "throughput", Checks: r.Throughput},
+		{Name: "udp", Checks: r.UDP},
+		{Name: "redis", Checks: r.Redis},
+		{Name: "cert", Checks: r.Certs},
+		{Name: "manual", Checks: r.Manual},
+	}
+}
+
+func (r *Report) checks() []CheckReport {
+	var checks []CheckReport
+	for _, category := range r.Categories() {
+		checks = append(checks, category.Checks...)
+	}
+	return checks
+}
+
+// FederatedReport summarises every namespace that has reported into this
+// redis, so one app can show the health of every app sharing it.  It only
+// reads: other apps' namespaces are theirs to prune, and their results are
+// aged but not judged stale against this app's check schedules.
+func (c *Checker) FederatedReport(ctx context.Context) map[string]interface{} {
+	namespaces, err := c.redis.SMembers(ctx, namespacesKey).Result()
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch namespaces from redis")
+	}
+	sort.Strings(namespaces)
+
+	var summaries []NamespaceSummary
+	for _, namespace := range namespaces {
+		keys := keyspace(namespace)
+		dynos, _ := c.liveDynos(ctx, keys)
+		opts := readOptions{}
+		if keys == c.keys {
+			opts.staleAfter = c.staleAfter
+		}
+		summary := NamespaceSummary{
+			Namespace: namespace,
+			Current:   keys == c.keys,
+			Dynos:     len(dynos),
+		}
+		for _, report := range c.readReports(ctx, keys, dynos, opts) {
+			for _, check := range report.checks() {
+				switch check.State() {
+				case "pass":
+					summary.Passed++
+				case "warn":
+					summary.Warned++
+				case "stale":
+					summary.Stale++
+				default:
+					summary.Failed++
+					summary.Failing = append(summary.Failing, FailingCheck{
+						Dyno:   report.Dyno,
+						Dest:   check.Dest,
+						Result: check.Result,
+					})
+				}
+			}
+		}
+		summaries = append(summaries, summary)
+	}
+
+	return map[string]interface{}{
+		"namespaces": summaries,
+	}
+}
@@ -0,0 +1,41 @@
+package liveness
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFederatedReportOnlyReadsOtherNamespaces(t *testing.T) {
+	_, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	other := keyspace("otherapp")
+	ctx := context.Background()
+
+	client.SAdd(ctx, namespacesKey, string(checker.keys), string(other))
+	heartbeat(t, client, checker.keys, "web.1")
+	heartbeat(t, client, other, "web.1")
+	// A dyno whose heartbeat has expired, and an index entry whose result
+	// has, are the other app's to prune.
+	client.SAdd(ctx, other.dynosKey(), "web.2")
+	client.SAdd(ctx, other.resultsIndexKey("web.1"), resultsIndexMember("private", "web.3"))
+	// The other app checks less often than this one, so a result older than
+	// this app's private limit is still current there.
+	old := time.Now().Add(-10 * time.Minute).Format(time.RFC3339)
+	client.Set(ctx, other.checkKey("private", "web.1", "web.2"), "pass:"+old, time.Hour)
+	client.SAdd(ctx, other.resultsIndexKey("web.1"), resultsIndexMember("private", "web.2"))
+
+	summaries := checker.FederatedReport(ctx)["namespaces"].([]NamespaceSummary)
+	if len(summaries) != 2 || summaries[1].Namespace != "otherapp" {
+		t.Fatalf("summaries = %+v, want myapp and otherapp", summaries)
+	}
+	if got := summaries[1]; got.Dynos != 1 || got.Passed != 1 || got.Stale != 0 {
+		t.Errorf("otherapp = %+v, want 1 dyno with 1 passing check", got)
+	}
+	if n, _ := client.SCard(ctx, other.dynosKey()).Result(); n != 2 {
+		t.Errorf("otherapp has %v dynos registered, want both left alone", n)
+	}
+	if n, _ := client.SCard(ctx, other.resultsIndexKey("web.1")).Result(); n != 2 {
+		t.Errorf("otherapp's index has %v entries, want both left alone", n)
+	}
+}
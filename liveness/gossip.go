@@ -0,0 +1,73 @@
+package liveness
+
+import (
+	"context"
+	"github.com/archa347/ps-network-test/gossip"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+func gossipKey(resultType string, dest string) string {
+	return resultType + "|" + dest
+}
+
+// gossipReport renders the report from the in-memory gossip state, for when
+// redis can't be reached.
+func (c *Checker) gossipReport() map[string]interface{} {
+	members := c.gossip.Members()
+	results := c.gossip.Results()
+
+	dynos := []string{c.dyno}
+	for _, m := range members {
+		if m.State != gossip.Dead {
+			dynos = append(dynos, m.ID)
+		}
+	}
+	sort.Strings(dynos)
+
+	var reports []Report
+	for _, dyno := range dynos {
+		reports = append(reports, reportFromResults(dyno, results[dyno]))
+	}
+
+	return map[string]interface{}{
+		"dynos":   reports,
+		"gossip":  true,
+		"members": members,
+	}
+}
+
+func reportFromResults(dyno string, results map[string]gossip.Result) Report {
+	keys := make([]string, 0, len(results))
+	for key := range results {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	report := Report{Dyno: dyno}
+	for _, key := range keys {
+		resultType, dest, _ := strings.Cut(key, "|")
+		report.Add(resultType, CheckReport{Dest: dest, Result: results[key].Value})
+	}
+	return report
+}
+
+// StartGossipJoin periodically introduces the gossip node to every peer we
+// can discover, so a restarted dyno rejoins even while the mesh is quiet.
+func (c *Checker) StartGossipJoin() {
+	go func() {
+		for {
+			var addrs []string
+			for _, peer := range c.getPeers(context.Background()) {
+				if peer == c.dyno {
+					continue
+				}
+				addrs = append(addrs, net.JoinHostPort(peer, c.gossipPort))
+			}
+			c.gossip.Join(addrs)
+			time.Sleep(30 * time.Second)
+		}
+	}()
+}
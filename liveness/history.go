@@ -0,0 +1,70 @@
+package liveness
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HistorySample is one aggregator observation of a result: whether it was
+// passing and, for checks that measure something, the headline number.
+type HistorySample struct {
+	Time  time.Time
+	State string
+	Value float64
+}
+
+func (s HistorySample) String() string {
+	return fmt.Sprintf("%v %v %v", s.Time.Unix(), s.State, strconv.FormatFloat(s.Value, 'f', -1, 64))
+}
+
+func parseSample(value string) (HistorySample, bool) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 {
+		return HistorySample{}, false
+	}
+	unix, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return HistorySample{}, false
+	}
+	v, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return HistorySample{}, false
+	}
+	return HistorySample{Time: time.Unix(unix, 0), State: fields[1], Value: v}, true
+}
+
+var sampleValues = map[string]struct {
+	pattern  *regexp.Regexp
+	duration bool
+}{
+	"latency":    {regexp.MustCompile(`avg=(\S+)`), true},
+	"redis":      {regexp.MustCompile(`ping=(\S+)`), true},
+	"udp":        {regexp.MustCompile(`loss=([0-9.]+)%`), false},
+	"throughput": {regexp.MustCompile(`down=([0-9.]+)Mbps`), false},
+}
+
+// sampleValue pulls the number worth graphing out of a result: milliseconds
+// for latency and redis, loss percentage for udp and download Mbps for
+// throughput.
+func sampleValue(resultType string, result string) float64 {
+	extract, ok := sampleValues[resultType]
+	if !ok {
+		return 0
+	}
+	match := extract.pattern.FindStringSubmatch(result)
+	if match == nil {
+		return 0
+	}
+	if extract.duration {
+		d, err := time.ParseDuration(match[1])
+		if err != nil {
+			return 0
+		}
+		return float64(d) / float64(time.Millisecond)
+	}
+	v, _ := strconv.ParseFloat(match[1], 64)
+	return v
+}
@@ -0,0 +1,248 @@
+package liveness
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Add files check under the report field for resultType.
+func (r *Report) Add(resultType string, check CheckReport) {
+	switch resultType {
+	case "dmz":
+		r.DMZ = append(r.DMZ, check)
+	case "nat":
+		r.NAT = append(r.NAT, check)
+	case "private":
+		r.Private = append(r.Private, check)
+	case "cert":
+		r.Certs = append(r.Certs, check)
+	case "udp":
+		r.UDP = append(r.UDP, check)
+	case "throughput":
+		r.Throughput = append(r.Throughput, check)
+	case "latency":
+		r.Latency = append(r.Latency, check)
+	case "dns":
+		r.DNS = append(r.DNS, check)
+	case "redis":
+		r.Redis = append(r.Redis, check)
+	case "manual":
+		r.Manual = append(r.Manual, check)
+	}
+}
+
+// getDynos returns the dynos in the dynos set whose heartbeat hasn't expired,
+// pruning the rest so the set doesn't grow with every dyno that ever ran.
+func (c *Checker) getDynos(ctx context.Context, keys keyspace) []string {
+	dynos, dead := c.liveDynos(ctx, keys)
+	if len(dead) > 0 {
+		// Every dyno serving the report prunes, so only the one whose SREM
+		// actually removed a dyno announces it left.  The dyno's keys that
+		// don't expire on their own go with it.
+		pipe := c.redis.Pipeline()
+		removed := make([]*redis.IntCmd, len(dead))
+		for i, dyno := range dead {
+			removed[i] = pipe.SRem(ctx, keys.dynosKey(), dyno)
+			pipe.Del(ctx, keys.resultsIndexKey(dyno), keys.outagesKey(dyno))
+		}
+		_, err := pipe.Exec(ctx)
+		if err != nil {
+			log.WithError(err).Warn("Unable to prune dynos")
+		}
+		for i, dyno := range dead {
+			if removed[i].Val() > 0 {
+				publishEvent(ctx, c.redis, keys, membershipEvent(dyno, "left"))
+			}
+		}
+	}
+	return dynos
+}
+
+// liveDynos splits the dynos set into the dynos whose heartbeat hasn't
+// expired and those whose has, without changing anything, so it's safe to
+// use on keyspaces this dyno doesn't own.
+func (c *Checker) liveDynos(ctx context.Context, keys keyspace) (live []string, dead []string) {
+	live = make([]string, 0)
+
+	members, err := c.redis.SMembers(ctx, keys.dynosKey()).Result()
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch dynos from redis")
+		return live, nil
+	}
+	sort.Strings(members)
+
+	pipe := c.redis.Pipeline()
+	exists := make([]*redis.IntCmd, len(members))
+	for i, dyno := range members {
+		exists[i] = pipe.Exists(ctx, keys.livenessKey(dyno))
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch dynos from redis")
+		return live, nil
+	}
+
+	for i, dyno := range members {
+		if exists[i].Val() > 0 {
+			live = append(live, dyno)
+		} else {
+			dead = append(dead, dyno)
+		}
+	}
+	return live, dead
+}
+
+// dynoReports reads every dyno's results in a fixed number of pipelined round
+// trips however many dynos and destinations there are: one for the indexes
+// and per-dyno keys, one for the results, and one for latency history and
+// pruning index entries whose results have expired.
+func (c *Checker) dynoReports(ctx context.Context, keys keyspace, dynos []string) []Report {
+	return c.readReports(ctx, keys, dynos, c.localRead())
+}
+
+// readOptions says how a report read treats the keyspace it reads.
+type readOptions struct {
+	// prune tidies up as the read goes, dropping dynos whose heartbeat has
+	// expired and index entries whose results have.  Leave it unset for a
+	// read that mustn't write, e.g. of another app's namespace or from a
+	// tool outside the app.
+	prune bool
+
+	// staleAfter is the staleness limit for each result type.  Another
+	// app's checks run on its own schedules, so reads of its namespace
+	// leave this nil and only report ages.
+	staleAfter map[string]time.Duration
+}
+
+// localRead is how a dyno reads its own namespace: tidying up as it goes,
+// and judging staleness against its own check schedules.
+func (c *Checker) localRead() readOptions {
+	return readOptions{prune: true, staleAfter: c.staleAfter}
+}
+
+// readDynos is getDynos for a read that may prune, and liveDynos otherwise.
+func (c *Checker) readDynos(ctx context.Context, keys keyspace, opts readOptions) []string {
+	if opts.prune {
+		return c.getDynos(ctx, keys)
+	}
+	dynos, _ := c.liveDynos(ctx, keys)
+	return dynos
+}
+
+func (c *Checker) readReports(ctx context.Context, keys keyspace, dynos []string, opts readOptions) []Report {
+	reports := make([]Report, len(dynos))
+
+	pipe := c.redis.Pipeline()
+	indexes := make([]*redis.StringSliceCmd, len(dynos))
+	dmz := make([]*redis.StringCmd, len(dynos))
+	outages := make([]*redis.StringSliceCmd, len(dynos))
+	clocks := make([]*redis.StringCmd, len(dynos))
+	for i, dyno := range dynos {
+		indexes[i] = pipe.SMembers(ctx, keys.resultsIndexKey(dyno))
+		dmz[i] = pipe.Get(ctx, keys.dmzKey(dyno))
+		outages[i] = pipe.LRange(ctx, keys.outagesKey(dyno), 0, -1)
+		clocks[i] = pipe.Get(ctx, keys.clockKey(dyno))
+	}
+	reference := pipe.Time(ctx)
+	_, err := pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		log.WithError(err).Warn("Unable to fetch results from redis")
+	}
+
+	// Ages are measured on redis's clock, with each result's time moved onto
+	// it using its dyno's offset.
+	now, err := reference.Result()
+	if err != nil {
+		now = time.Now()
+	}
+
+	// Every result key shares its dyno's hash tag, so each MGET is
+	// single-slot even in a cluster.
+	pipe = c.redis.Pipeline()
+	members := make([][]string, len(dynos))
+	values := make([]*redis.SliceCmd, len(dynos))
+	for i, dyno := range dynos {
+		reports[i].Dyno = dyno
+		reports[i].Outages = outages[i].Val()
+		reports[i].Clock = c.decodeClock(clocks[i].Val())
+		if result, err := dmz[i].Result(); err == nil {
+			check := CheckReport{Result: result}
+			if reports[i].Clock != nil {
+				normalizeResult(&check, reports[i].Clock.Redis)
+			}
+			markStale(opts.staleAfter, "dmz", &check, now)
+			reports[i].DMZ = []CheckReport{check}
+		}
+
+		members[i] = indexes[i].Val()
+		sort.Strings(members[i])
+		if len(members[i]) == 0 {
+			continue
+		}
+		resultKeys := make([]string, len(members[i]))
+		for j, member := range members[i] {
+			resultType, dest, _ := strings.Cut(member, "|")
+			resultKeys[j] = keys.checkKey(resultType, dyno, dest)
+		}
+		values[i] = pipe.MGet(ctx, resultKeys...)
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		log.WithError(err).Warn("Unable to fetch results from redis")
+	}
+
+	pipe = c.redis.Pipeline()
+	type trend struct {
+		report int
+		check  int
+		cmd    *redis.StringSliceCmd
+	}
+	var trends []trend
+	for i, dyno := range dynos {
+		if values[i] == nil {
+			continue
+		}
+		var expired []interface{}
+		for j, value := range values[i].Val() {
+			resultType, dest, _ := strings.Cut(members[i][j], "|")
+			if value == nil {
+				expired = append(expired, members[i][j])
+				continue
+			}
+			check := CheckReport{Dest: dest, Result: fmt.Sprintf("%v", value)}
+			if clock := reports[i].Clock; clock != nil {
+				normalizeResult(&check, clock.Redis)
+			}
+			markStale(opts.staleAfter, resultType, &check, now)
+			reports[i].Add(resultType, check)
+			if resultType == "latency" {
+				trends = append(trends, trend{
+					report: i,
+					check:  len(reports[i].Latency) - 1,
+					cmd:    pipe.LRange(ctx, keys.latencyHistoryKey(dyno, dest), 0, -1),
+				})
+			}
+		}
+		if opts.prune && len(expired) > 0 {
+			pipe.SRem(ctx, keys.resultsIndexKey(dyno), expired...)
+		}
+	}
+	_, err = pipe.Exec(ctx)
+	if err != nil && err != redis.Nil {
+		log.WithError(err).Warn("Unable to fetch latency history from redis")
+	}
+	for _, t := range trends {
+		samples := t.cmd.Val()
+		for l, r := 0, len(samples)-1; l < r; l, r = l+1, r-1 {
+			samples[l], samples[r] = samples[r], samples[l]
+		}
+		reports[t.report].Latency[t.check].Trend = strings.Join(samples, " ")
+	}
+
+	return reports
+}
@@ -0,0 +1,200 @@
+package liveness
+
+import (
+	"context"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	redisclient "github.com/archa347/ps-network-test/redis"
+	"github.com/go-redis/redis/v8"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestChecker(t testing.TB, client redisclient.Store, dyno string) *Checker {
+	cfg := config.Config{
+		DynoID:           dyno,
+		AppName:          "myapp",
+		Namespace:        "myapp",
+		RedisBufferSize:  100,
+		PrivateCheckCron: "*/30 * * * * *",
+		NATCheckCron:     "0 * * * * *",
+		DMZCheckCron:     "0 * * * * *",
+		UDPCheckCron:     "0 * * * * *",
+		LatencyCheckCron: "0 * * * * *",
+		RedisCheckCron:   "0 * * * * *",
+	}
+	return NewChecker(cfg, client, nil, nil, NewWriteBuffer(cfg, client))
+}
+
+// heartbeat registers dyno as alive the way the reporter does.
+func heartbeat(t testing.TB, client redisclient.Store, keys keyspace, dyno string) {
+	ctx := context.Background()
+	err := client.Set(ctx, keys.livenessKey(dyno), "healthy:"+timeTag(), time.Minute).Err()
+	if err == nil {
+		err = client.SAdd(ctx, keys.dynosKey(), dyno).Err()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReportReadsIndexedResults(t *testing.T) {
+	server, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	other := newTestChecker(t, client, "web.2")
+	ctx := context.Background()
+
+	heartbeat(t, client, checker.keys, "web.1")
+	heartbeat(t, client, checker.keys, "web.2")
+	checker.storeResult(ctx, "private", "web.2", "pass:"+timeTag())
+	checker.storeResult(ctx, "udp", "web.2", "warn:loss=10%:"+timeTag())
+	other.storeResult(ctx, "private", "web.1", "fail:refused:"+timeTag())
+
+	reports := checker.dynoReports(ctx, checker.keys, checker.getDynos(ctx, checker.keys))
+	if len(reports) != 2 || reports[0].Dyno != "web.1" || reports[1].Dyno != "web.2" {
+		t.Fatalf("reports = %+v, want web.1 and web.2", reports)
+	}
+	if len(reports[0].Private) != 1 || reports[0].Private[0].Dest != "web.2" || !reports[0].Private[0].Passed() {
+		t.Errorf("web.1 private = %+v", reports[0].Private)
+	}
+	if len(reports[0].UDP) != 1 || !reports[0].UDP[0].Warned() {
+		t.Errorf("web.1 udp = %+v", reports[0].UDP)
+	}
+	if len(reports[1].Private) != 1 || reports[1].Private[0].State() != "fail" {
+		t.Errorf("web.2 private = %+v", reports[1].Private)
+	}
+
+	// Once its results expire, their index entries are pruned too.
+	server.FastForward(11 * time.Minute)
+	heartbeat(t, client, checker.keys, "web.1")
+	heartbeat(t, client, checker.keys, "web.2")
+	checker.dynoReports(ctx, checker.keys, checker.getDynos(ctx, checker.keys))
+	if n, _ := client.SCard(ctx, checker.keys.resultsIndexKey("web.1")).Result(); n != 0 {
+		t.Errorf("index still has %v expired entries", n)
+	}
+}
+
+func TestGetDynosPrunesDeadDynos(t *testing.T) {
+	server, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	ctx := context.Background()
+
+	heartbeat(t, client, checker.keys, "web.2")
+	other := newTestChecker(t, client, "web.2")
+	other.storeResult(ctx, "private", "web.1", "pass:"+timeTag())
+	client.LPush(ctx, checker.keys.outagesKey("web.2"), "outage")
+
+	server.FastForward(2 * time.Minute)
+	if dynos := checker.getDynos(ctx, checker.keys); len(dynos) != 0 {
+		t.Errorf("dynos = %v, want none", dynos)
+	}
+	// Results expire on their own; the keys without a TTL have to go with
+	// the dyno.
+	for _, key := range []string{checker.keys.resultsIndexKey("web.2"), checker.keys.outagesKey("web.2")} {
+		if n, _ := client.Exists(ctx, key).Result(); n != 0 {
+			t.Errorf("%v outlived its dyno", key)
+		}
+	}
+}
+
+func TestReadReportOnlyReads(t *testing.T) {
+	server, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	run := newTestChecker(t, client, "run.1")
+	ctx := context.Background()
+
+	heartbeat(t, client, checker.keys, "web.1")
+	heartbeat(t, client, checker.keys, "web.2")
+	checker.storeResult(ctx, "private", "web.2", "pass:"+timeTag())
+	run.RecordProbe(ctx, ProbeResult{Type: "nat", Dest: "https://example.com", Result: "pass:" + timeTag()})
+
+	// web.2 stops, and run.1's probe and web.1's result expire.
+	server.FastForward(11 * time.Minute)
+	heartbeat(t, client, checker.keys, "web.1")
+	before := server.Keys()
+	reports, err := checker.ReadReport(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Dyno != "web.1" {
+		t.Errorf("reports = %+v, want only web.1", reports)
+	}
+	for _, key := range []string{checker.keys.dynosKey(), checker.keys.resultsIndexKey("web.1"), checker.keys.oneOffsKey()} {
+		if n, _ := client.SCard(ctx, key).Result(); n == 0 {
+			t.Errorf("%v was pruned", key)
+		}
+	}
+	if after := server.Keys(); len(after) != len(before) {
+		t.Errorf("keys went from %v to %v", before, after)
+	}
+
+	server.SetDown(true)
+	if _, err := checker.ReadReport(ctx); err == nil {
+		t.Error("no error with redis down")
+	}
+}
+
+// roundTrips counts the requests a client sends, a pipeline counting once.
+type roundTrips struct {
+	n int64
+}
+
+func (h *roundTrips) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&h.n, 1)
+	return ctx, nil
+}
+
+func (h *roundTrips) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (h *roundTrips) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	atomic.AddInt64(&h.n, 1)
+	return ctx, nil
+}
+
+func (h *roundTrips) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// BenchmarkReport builds the report for fleets of increasing size.  The
+// roundtrips/op metric stays the same however many dynos and destinations
+// there are; only the size of each pipeline grows.
+func BenchmarkReport(b *testing.B) {
+	for _, size := range []struct{ dynos, dests int }{{10, 10}, {100, 20}, {1000, 20}, {3000, 10}} {
+		b.Run(fmt.Sprintf("dynos=%v/dests=%v", size.dynos, size.dests), func(b *testing.B) {
+			_, client := newTestStore(b)
+			checker := newTestChecker(b, client, "web.1")
+			keys := checker.keys
+			ctx := context.Background()
+
+			pipe := client.Pipeline()
+			for i := 0; i < size.dynos; i++ {
+				dyno := fmt.Sprintf("web.%v", i+1)
+				pipe.Set(ctx, keys.livenessKey(dyno), "healthy:"+timeTag(), time.Hour)
+				pipe.SAdd(ctx, keys.dynosKey(), dyno)
+				for j := 0; j < size.dests; j++ {
+					dest := fmt.Sprintf("web.%v", j+1)
+					pipe.Set(ctx, keys.checkKey("private", dyno, dest), "pass:"+timeTag(), time.Hour)
+					pipe.SAdd(ctx, keys.resultsIndexKey(dyno), resultsIndexMember("private", dest))
+				}
+			}
+			_, err := pipe.Exec(ctx)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			trips := &roundTrips{}
+			client.(*redis.Client).AddHook(trips)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				reports := checker.dynoReports(ctx, keys, checker.getDynos(ctx, keys))
+				if len(reports) != size.dynos || len(reports[0].Private) != size.dests {
+					b.Fatalf("got %v dynos with %v results", len(reports), len(reports[0].Private))
+				}
+			}
+			b.ReportMetric(float64(atomic.LoadInt64(&trips.n))/float64(b.N), "roundtrips/op")
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package liveness
+
+import (
+	"fmt"
+)
+
+// Keys that belong to a dyno wrap its ID in a hash tag, so in a redis cluster
+// all of a dyno's keys share a slot and can be read together with MGET.
+
+// namespacesKey is the one key outside any namespace: the set of namespaces
+// that have written to this redis, for the federated report.
+const namespacesKey = "namespaces"
+
+// keyspace prefixes every key with a namespace so several apps can share
+// one redis without reading each other's results.
+type keyspace string
+
+// unnamespaced is the layout from before keys were namespaced, which dynos
+// still running an older release keep writing to until they restart.
+const unnamespaced keyspace = ""
+
+func (k keyspace) key(suffix string) string {
+	if k == unnamespaced {
+		return suffix
+	}
+	return string(k) + ":" + suffix
+}
+
+func (k keyspace) dynosKey() string {
+	return k.key("dynos")
+}
+
+func (k keyspace) natCheckURLKey() string {
+	return k.key("settings:NATCheckURL")
+}
+
+func (k keyspace) throughputLockKey() string {
+	return k.key("throughput:lock")
+}
+
+func dynoTag(dynoID string) string {
+	return "{" + dynoID + "}"
+}
+
+func (k keyspace) livenessKey(dynoID string) string {
+	return k.key("liveness:" + dynoTag(dynoID))
+}
+
+func (k keyspace) dmzKey(dynoID string) string {
+	return k.key("dmz:" + dynoTag(dynoID))
+}
+
+func (k keyspace) privateKey(dynoID string) string {
+	return k.key("private:" + dynoTag(dynoID))
+}
+
+func (k keyspace) checkKey(resultType string, dynoID string, dest string) string {
+	return k.key(fmt.Sprintf("%v:src:%v:dest:%v", resultType, dynoTag(dynoID), dest))
+}
+
+func (k keyspace) latencyHistoryKey(dynoID string, dest string) string {
+	return k.key(fmt.Sprintf("latency:history:src:%v:dest:%v", dynoTag(dynoID), dest))
+}
+
+func (k keyspace) outagesKey(dynoID string) string {
+	return k.key("outages:" + dynoTag(dynoID))
+}
+
+func (k keyspace) redisProbeKey(dynoID string) string {
+	return k.key("redisprobe:" + dynoTag(dynoID))
+}
+
+func (k keyspace) dnsNamesKey() string {
+	return k.key("dns:names")
+}
+
+func (k keyspace) dnsAnswersKey(name string) string {
+	return k.key("dns:answers:" + name)
+}
+
+// resultsIndexKey is the set of "<type>|<dest>" results a dyno has written,
+// so its report can be read without scanning the keyspace.
+func (k keyspace) resultsIndexKey(dynoID string) string {
+	return k.key("results:index:" + dynoTag(dynoID))
+}
+
+func resultsIndexMember(resultType string, dest string) string {
+	return resultType + "|" + dest
+}
+
+// schemaVersionKey records which key layout the data in a namespace is in.
+// It's missing for data written before namespacing, which is version 1.
+func (k keyspace) schemaVersionKey() string {
+	return k.key("schema:version")
+}
+
+func (k keyspace) aggregatorLockKey() string {
+	return k.key("aggregator:lock")
+}
+
+// historyKey is the aggregator's sampled history of one of a dyno's
+// results, newest first.
+func (k keyspace) historyKey(dynoID string, member string) string {
+	return k.key("history:" + dynoTag(dynoID) + ":" + member)
+}
+
+func (k keyspace) sloKey() string {
+	return k.key("slo:rollups")
+}
+
+func (k keyspace) alertsKey() string {
+	return k.key("alerts")
+}
+
+// eventsChannel is the pub/sub channel results and membership changes are
+// published on as they're written.
+func (k keyspace) eventsChannel() string {
+	return k.key("events")
+}
+
+// lastResultKey is when a dyno last stored any result.  It outlives the
+// results themselves so a dyno that stopped checking can still be spotted
+// once they've expired.
+func (k keyspace) lastResultKey(dynoID string) string {
+	return k.key("lastresult:" + dynoTag(dynoID))
+}
+
+// clockKey is a dyno's latest clock offset measurement, written alongside
+// its heartbeat.
+func (k keyspace) clockKey(dynoID string) string {
+	return k.key("clock:" + dynoTag(dynoID))
+}
+
+// oneOffsKey is the set of one-off dynos, like those `heroku run` starts,
+// that have recorded probe results.  They don't heartbeat, so they're kept
+// out of the dynos set and never probed.
+func (k keyspace) oneOffsKey() string {
+	return k.key("oneoffs")
+}
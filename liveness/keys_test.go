@@ -0,0 +1,100 @@
+package liveness
+
+import (
+	"context"
+	"github.com/archa347/ps-network-test/config"
+	"github.com/archa347/ps-network-test/redis"
+	"github.com/archa347/ps-network-test/redis/memstore"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hashTag is the part of key redis cluster hashes to pick a slot: the
+// contents of the first non-empty {...}, or the whole key without one.
+func hashTag(key string) string {
+	start := strings.Index(key, "{")
+	if start < 0 {
+		return key
+	}
+	end := strings.Index(key[start+1:], "}")
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+// newTestStore starts an in-memory store and returns a client for it.
+func newTestStore(t testing.TB) (*memstore.Server, redis.Store) {
+	server, err := memstore.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	client, err := redis.RedisClient(config.Config{RedisURL: "redis://" + server.Addr(), RedisMode: redis.ModeSingle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return server, client
+}
+
+func TestDynoKeysShareHashTag(t *testing.T) {
+	keys := keyspace("myapp")
+	dyno := "web.1"
+	dynoKeys := []string{
+		keys.livenessKey(dyno),
+		keys.dmzKey(dyno),
+		keys.privateKey(dyno),
+		keys.checkKey("nat", dyno, "https://example.com/{not-a-tag}"),
+		keys.checkKey("private", dyno, "web.2"),
+		keys.latencyHistoryKey(dyno, "web.2"),
+		keys.outagesKey(dyno),
+		keys.redisProbeKey(dyno),
+		keys.resultsIndexKey(dyno),
+		keys.historyKey(dyno, "udp|web.2"),
+		keys.lastResultKey(dyno),
+		keys.clockKey(dyno),
+	}
+	for _, key := range dynoKeys {
+		if !strings.HasPrefix(key, "myapp:") {
+			t.Errorf("%v is outside the namespace", key)
+		}
+		if got := hashTag(key); got != dyno {
+			t.Errorf("%v hashes on %q, want %q", key, got, dyno)
+		}
+	}
+
+	// Keys for different dynos must be able to land on different nodes.
+	if hashTag(keys.livenessKey("web.1")) == hashTag(keys.livenessKey("web.2")) {
+		t.Errorf("dynos share a hash tag")
+	}
+}
+
+func TestResultWriteIsOneTransaction(t *testing.T) {
+	server, client := newTestStore(t)
+	cfg := config.Config{DynoID: "web.1", Namespace: "myapp", RedisBufferSize: 10}
+	buffer := NewWriteBuffer(cfg, client)
+	keys := keyspace(cfg.Namespace)
+
+	ctx := context.Background()
+	err := buffer.SetResult(ctx, keys.checkKey("udp", "web.1", "web.2"), "pass", time.Minute,
+		resultsIndexMember("udp", "web.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := server.Keys()
+	if len(stored) != 3 {
+		t.Fatalf("stored %v, want the result, its index and the last result time", stored)
+	}
+	for _, key := range stored {
+		if hashTag(key) != "web.1" {
+			t.Errorf("%v is outside the dyno's slot", key)
+		}
+	}
+	members, _ := client.SMembers(ctx, keys.resultsIndexKey("web.1")).Result()
+	if len(members) != 1 || members[0] != "udp|web.2" {
+		t.Errorf("index = %v, want udp|web.2", members)
+	}
+}
@@ -0,0 +1,107 @@
+package liveness
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"time"
+)
+
+// latencyHistoryLength is how many past samples the report shows as a trend.
+const latencyHistoryLength = 30
+
+type LatencyStats struct {
+	Samples int
+	Failed  int
+	Min     time.Duration
+	Avg     time.Duration
+	Max     time.Duration
+	StdDev  time.Duration
+	P95     time.Duration
+}
+
+func (s LatencyStats) String() string {
+	return fmt.Sprintf("min=%v avg=%v max=%v stddev=%v p95=%v (%v/%v samples)",
+		round(s.Min), round(s.Avg), round(s.Max), round(s.StdDev), round(s.P95), s.Samples-s.Failed, s.Samples)
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Microsecond)
+}
+
+// probeTCPLatency times count TCP handshakes to addr.  No request is ever
+// sent, but when tlsConfig is set each connection finishes a TLS handshake
+// before it's closed, so a TLS listener doesn't log every sample as a failed
+// handshake.  Only the TCP connect is timed.
+func probeTCPLatency(ctx context.Context, addr string, tlsConfig *tls.Config, count int, timeout time.Duration) (LatencyStats, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	if tlsConfig != nil && tlsConfig.ServerName == "" {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	stats := LatencyStats{Samples: count}
+	var samples []time.Duration
+	var lastErr error
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		elapsed := time.Since(start)
+		if err != nil {
+			stats.Failed++
+			lastErr = err
+			continue
+		}
+		if tlsConfig != nil {
+			conn.SetDeadline(time.Now().Add(timeout))
+			conn = tls.Client(conn, tlsConfig)
+			conn.(*tls.Conn).HandshakeContext(ctx)
+		}
+		conn.Close()
+		samples = append(samples, elapsed)
+	}
+	if len(samples) == 0 {
+		return stats, lastErr
+	}
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+	var total time.Duration
+	for _, sample := range samples {
+		total += sample
+	}
+	stats.Min = samples[0]
+	stats.Max = samples[len(samples)-1]
+	stats.Avg = total / time.Duration(len(samples))
+	var variance float64
+	for _, sample := range samples {
+		diff := float64(sample - stats.Avg)
+		variance += diff * diff
+	}
+	stats.StdDev = time.Duration(math.Sqrt(variance / float64(len(samples))))
+	stats.P95 = samples[int(math.Ceil(0.95*float64(len(samples))))-1]
+	return stats, nil
+}
+
+func latencyResult(stats LatencyStats, err error) string {
+	switch {
+	case err != nil:
+		return failResult(err)
+	case stats.Failed > 0:
+		return fmt.Sprintf("warn:%v:%v", stats, timeTag())
+	default:
+		return fmt.Sprintf("pass:%v:%v", stats, timeTag())
+	}
+}
+
+func (c *Checker) recordLatencyHistory(ctx context.Context, dest string, stats LatencyStats) error {
+	key := c.keys.latencyHistoryKey(c.dyno, dest)
+	sample := fmt.Sprintf("%v/%v", round(stats.Avg), round(stats.P95))
+	pipe := c.redis.TxPipeline()
+	pipe.LPush(ctx, key, sample)
+	pipe.LTrim(ctx, key, 0, latencyHistoryLength-1)
+	pipe.Expire(ctx, key, time.Hour)
+	_, err := pipe.Exec(ctx)
+	return err
+}
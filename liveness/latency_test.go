@@ -0,0 +1,79 @@
+package liveness
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProbeTCPLatency(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	tests := []struct {
+		name      string
+		serverTLS *tls.Config
+		clientTLS *tls.Config
+	}{
+		{name: "plain"},
+		{name: "tls", serverTLS: serverTLS, clientTLS: clientTLS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			// Every connection to a TLS listener has to complete its
+			// handshake, or the peer logs it as an error.
+			handshakes := make(chan error, 10)
+			go func() {
+				for {
+					conn, err := listener.Accept()
+					if err != nil {
+						return
+					}
+					if tt.serverTLS != nil {
+						handshakes <- tls.Server(conn, tt.serverTLS).Handshake()
+					}
+					conn.Close()
+				}
+			}()
+
+			stats, err := probeTCPLatency(context.Background(), listener.Addr().String(), tt.clientTLS, 5, time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Samples != 5 || stats.Failed != 0 || stats.Min <= 0 || stats.Min > stats.Max || stats.P95 > stats.Max {
+				t.Errorf("stats = %+v", stats)
+			}
+			if tt.serverTLS == nil {
+				return
+			}
+			for i := 0; i < 5; i++ {
+				if err := <-handshakes; err != nil {
+					t.Errorf("handshake %v: %v", i, err)
+				}
+			}
+		})
+	}
+}
+
+func TestProbeTCPLatencyRefused(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	stats, err := probeTCPLatency(context.Background(), addr, nil, 3, time.Second)
+	if err == nil || stats.Failed != 3 {
+		t.Errorf("stats = %+v, err = %v, want every sample refused", stats, err)
+	}
+	if result := latencyResult(stats, err); result[:5] != "fail:" {
+		t.Errorf("result = %v", result)
+	}
+}
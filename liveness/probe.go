@@ -0,0 +1,282 @@
+package liveness
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProbeTypes are the probes Probe can run, named after the result types the
+// scheduled checks store them under.
+var ProbeTypes = []string{"nat", "dmz", "private", "udp", "latency", "throughput", "dns", "redis"}
+
+// ProbeResult is everything a one-shot probe found out, including the parts
+// the scheduled checks don't keep.
+type ProbeResult struct {
+	Type    string
+	Dest    string
+	Result  string
+	Class   string
+	Error   string
+	Elapsed time.Duration
+	HTTP    *HTTPTiming `json:",omitempty"`
+	Cert    string      `json:",omitempty"`
+}
+
+func (r ProbeResult) Passed() bool {
+	return strings.HasPrefix(r.Result, "pass")
+}
+
+// HTTPTiming breaks an HTTP request down into its phases.  Phases that didn't
+// happen, e.g. DNS for an IP or TLS over a reused connection, are zero.
+type HTTPTiming struct {
+	RemoteAddr string
+	Reused     bool
+	DNS        time.Duration
+	Connect    time.Duration
+	TLS        time.Duration
+	FirstByte  time.Duration
+}
+
+func (t *HTTPTiming) String() string {
+	return fmt.Sprintf("remote=%v reused=%v dns=%v connect=%v tls=%v first_byte=%v",
+		t.RemoteAddr, t.Reused, round(t.DNS), round(t.Connect), round(t.TLS), round(t.FirstByte))
+}
+
+func traceHTTP(ctx context.Context, timing *HTTPTiming) context.Context {
+	var start, dnsStart, connectStart, tlsStart time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GetConn:  func(string) { start = time.Now() },
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { timing.DNS = time.Since(dnsStart) },
+		ConnectStart: func(string, string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			timing.Connect = time.Since(connectStart)
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			timing.TLS = time.Since(tlsStart)
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			timing.Reused = info.Reused
+			if info.Conn != nil {
+				timing.RemoteAddr = info.Conn.RemoteAddr().String()
+			}
+		},
+		GotFirstResponseByte: func() { timing.FirstByte = time.Since(start) },
+	})
+}
+
+// Probe runs one probe of probeType against dest right away, the way the
+// scheduled check would, without storing the result.  For nat, dest can be a
+// configured target's name to use its method, headers and assertions.  For
+// dns, dest is a name, optionally followed by @resolver/network.
+func (c *Checker) Probe(ctx context.Context, probeType string, dest string) (ProbeResult, error) {
+	probe := ProbeResult{Type: probeType, Dest: dest}
+	start := time.Now()
+	var err error
+	switch probeType {
+	case "nat":
+		// A one-shot probe has no pooled connection to reuse, so a target
+		// checked both ways is probed the fresh way.
+		target := c.findTarget(dest)
+		modes := target.ConnectionModes()
+		client := http.DefaultClient
+		if modes[len(modes)-1] == config.ConnectionFresh {
+			client = freshClient(client)
+		}
+		err = c.probeHTTP(ctx, &probe, target, client)
+	case "dmz":
+		if dest == "" {
+			probe.Dest = c.getDMZURL()
+		}
+		err = c.probeHTTP(ctx, &probe, config.Target{URL: probe.Dest}, http.DefaultClient)
+	case "private":
+		target := config.Target{URL: fmt.Sprintf("%v://%v:7777/private", c.privateScheme, dest)}
+		err = c.probeHTTP(ctx, &probe, target, c.privateClient)
+	case "udp":
+		var stats UDPStats
+		stats, err = probeUDP(ctx, net.JoinHostPort(dest, c.udpPort), c.udpBurstCount, 10*time.Millisecond, 2*time.Second)
+		probe.Result = udpResult(stats, err)
+	case "latency":
+		var stats LatencyStats
+		stats, err = probeTCPLatency(ctx, net.JoinHostPort(dest, "7777"), c.privateTLS, c.latencySamples, 3*time.Second)
+		probe.Result = latencyResult(stats, err)
+	case "throughput":
+		err = c.probeThroughput(ctx, &probe)
+	case "dns":
+		name, resolver, network := c.splitDNSDest(dest)
+		if resolver == "" {
+			probe.Dest = name + "@system"
+			probe.Result, err = querySystemDNS(ctx, name)
+			break
+		}
+		probe.Dest = fmt.Sprintf("%v@%v/%v", name, resolver, network)
+		probe.Result, _, err = queryDNS(ctx, name, resolver, network)
+	case "redis":
+		var stats RedisStats
+		stats, err = c.probeRedis(ctx)
+		if err != nil {
+			probe.Result = failResult(err)
+		} else {
+			probe.Result = fmt.Sprintf("pass:%v:%v", stats, timeTag())
+		}
+	default:
+		return probe, fmt.Errorf("unknown probe type %q, expected one of %v", probeType, strings.Join(ProbeTypes, ", "))
+	}
+	probe.Elapsed = time.Since(start)
+	if err != nil {
+		probe.Error = err.Error()
+		probe.Class = failureClass(err)
+	}
+	return probe, nil
+}
+
+// RecordProbe stores a probe's result under the manual result type, so it
+// shows up in the report alongside the scheduled checks.  A one-off dyno,
+// like the run.N dyno `heroku run` starts, doesn't heartbeat, so it's
+// registered as a one-off to be reported without its peers probing it.
+func (c *Checker) RecordProbe(ctx context.Context, probe ProbeResult) error {
+	err := c.storeResult(ctx, "manual", probe.Type+" "+probe.Dest, probe.Result)
+	if err != nil {
+		return err
+	}
+	for _, dyno := range c.getDynos(ctx, c.keys) {
+		if dyno == c.dyno {
+			return nil
+		}
+	}
+	return c.redis.SAdd(ctx, c.keys.oneOffsKey(), c.dyno).Err()
+}
+
+// oneOffReports reports the one-off dynos not in current that have recorded
+// probes, forgetting those whose results have all expired if opts allows.
+func (c *Checker) oneOffReports(ctx context.Context, current []Report, opts readOptions) []Report {
+	members, err := c.redis.SMembers(ctx, c.keys.oneOffsKey()).Result()
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch one-off dynos from redis")
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, report := range current {
+		known[report.Dyno] = true
+	}
+	var dynos []string
+	for _, dyno := range members {
+		if !known[dyno] {
+			dynos = append(dynos, dyno)
+		}
+	}
+	sort.Strings(dynos)
+
+	var reports []Report
+	var gone []interface{}
+	for _, report := range c.readReports(ctx, c.keys, dynos, opts) {
+		if len(report.Manual) == 0 {
+			gone = append(gone, report.Dyno)
+			continue
+		}
+		reports = append(reports, report)
+	}
+	if opts.prune && len(gone) > 0 {
+		c.redis.SRem(ctx, c.keys.oneOffsKey(), gone...)
+	}
+	return reports
+}
+
+// querySystemDNS resolves name through the OS resolver, for a probe with no
+// resolver configured to query directly.
+func querySystemDNS(ctx context.Context, name string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	addrs, err := net.DefaultResolver.LookupIP(ctx, "ip4", name)
+	elapsed := time.Since(start).Round(time.Microsecond)
+	if err != nil {
+		return failResult(fmt.Errorf("%w (%v)", err, elapsed)), err
+	}
+	var addresses []string
+	for _, addr := range addrs {
+		addresses = append(addresses, addr.String())
+	}
+	sort.Strings(addresses)
+	return fmt.Sprintf("pass:%v (%v):%v", strings.Join(addresses, ","), elapsed, timeTag()), nil
+}
+
+func (c *Checker) findTarget(dest string) config.Target {
+	for _, target := range c.targets {
+		if target.Name == dest || target.URL == dest {
+			return target
+		}
+	}
+	return config.Target{URL: dest}
+}
+
+func (c *Checker) probeHTTP(ctx context.Context, probe *ProbeResult, target config.Target, client *http.Client) error {
+	if target.Type == config.TargetScript {
+		timings, err := runScript(ctx, target, client)
+		if err != nil {
+			probe.Result = failResult(fmt.Errorf("%w (%v)", err, formatTimings(timings)))
+		} else {
+			probe.Result = fmt.Sprintf("pass:%v:%v", formatTimings(timings), timeTag())
+		}
+		return err
+	}
+
+	probe.HTTP = &HTTPTiming{}
+	tlsState, err := fetchTarget(traceHTTP(ctx, probe.HTTP), target, client)
+	if err != nil {
+		probe.Result = failResult(err)
+	} else {
+		probe.Result = fmt.Sprintf("pass:%v", timeTag())
+	}
+	if info, ok := peerCertInfo(tlsState); ok {
+		probe.Cert = certResult(info, c.certWarnDays, time.Now())
+	}
+	return err
+}
+
+func (c *Checker) probeThroughput(ctx context.Context, probe *ProbeResult) error {
+	err := c.knownPeer(ctx, probe.Dest)
+	if err != nil {
+		probe.Result = failResult(err)
+		return err
+	}
+	release, err := c.lockThroughput(ctx)
+	if err != nil {
+		probe.Result = failResult(err)
+		return err
+	}
+	defer release()
+
+	stats, err := c.measureThroughput(ctx, probe.Dest)
+	if err != nil {
+		probe.Result = failResult(err)
+	} else {
+		probe.Result = fmt.Sprintf("pass:%v:%v", stats, timeTag())
+	}
+	return err
+}
+
+func (c *Checker) splitDNSDest(dest string) (string, string, string) {
+	name, server, _ := strings.Cut(dest, "@")
+	resolver, network, _ := strings.Cut(server, "/")
+	if resolver == "" && len(c.dnsResolvers) > 0 {
+		resolver = c.dnsResolvers[0]
+	}
+	if network == "" {
+		network = dnsNetworks[0]
+	}
+	return name, resolver, network
+}
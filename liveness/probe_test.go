@@ -0,0 +1,108 @@
+package liveness
+
+import (
+	"context"
+	"github.com/archa347/ps-network-test/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordProbeFromOneOffDyno(t *testing.T) {
+	server, client := newTestStore(t)
+	web := newTestChecker(t, client, "web.1")
+	run := newTestChecker(t, client, "run.1")
+	ctx := context.Background()
+
+	heartbeat(t, client, web.keys, "web.1")
+	err := run.RecordProbe(ctx, ProbeResult{Type: "nat", Dest: "https://example.com", Result: "pass:" + timeTag()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reports := web.Report(ctx)["dynos"].([]Report)
+	if len(reports) != 2 || reports[1].Dyno != "run.1" || len(reports[1].Manual) != 1 {
+		t.Fatalf("reports = %+v, want run.1's probe", reports)
+	}
+	if peers := web.getPeers(ctx); len(peers) != 1 || peers[0] != "web.1" {
+		t.Errorf("peers = %v, one-off dynos aren't probed", peers)
+	}
+
+	// Once the probe expires, the one-off dyno is forgotten.
+	server.FastForward(11 * time.Minute)
+	heartbeat(t, client, web.keys, "web.1")
+	if reports := web.Report(ctx)["dynos"].([]Report); len(reports) != 1 {
+		t.Errorf("reports = %+v, want only web.1", reports)
+	}
+	if n, _ := client.SCard(ctx, web.keys.oneOffsKey()).Result(); n != 0 {
+		t.Errorf("%v expired one-off dynos still registered", n)
+	}
+}
+
+func TestProbeNATConnectionMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	_, client := newTestStore(t)
+	checker := newTestChecker(t, client, "run.1")
+	ctx := context.Background()
+
+	tests := []struct {
+		connection string
+		wantReused bool
+	}{
+		{connection: config.ConnectionPooled, wantReused: true},
+		{connection: config.ConnectionFresh, wantReused: false},
+		{connection: config.ConnectionBoth, wantReused: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.connection, func(t *testing.T) {
+			checker.targets = []config.Target{{Name: "api", URL: server.URL, Connection: tt.connection}}
+			var probe ProbeResult
+			for i := 0; i < 2; i++ {
+				var err error
+				probe, err = checker.Probe(ctx, "nat", "api")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !probe.Passed() {
+					t.Fatalf("probe failed: %v", probe.Result)
+				}
+			}
+			if probe.HTTP.Reused != tt.wantReused {
+				t.Errorf("reused = %v, want %v", probe.HTTP.Reused, tt.wantReused)
+			}
+		})
+	}
+}
+
+func TestProbeDNSDefaultsToSystemResolver(t *testing.T) {
+	_, client := newTestStore(t)
+	checker := newTestChecker(t, client, "run.1")
+
+	probe, err := checker.Probe(context.Background(), "dns", "localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe.Dest != "localhost@system" || !probe.Passed() || !strings.Contains(probe.Result, "127.0.0.1") {
+		t.Errorf("probe = %+v, want localhost resolved by the system resolver", probe)
+	}
+}
+
+func TestProbeThroughputRejectsUnknownPeer(t *testing.T) {
+	_, client := newTestStore(t)
+	checker := newTestChecker(t, client, "run.1")
+	heartbeat(t, client, checker.keys, "web.1")
+
+	probe, err := checker.Probe(context.Background(), "throughput", "203.0.113.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if probe.Passed() || !strings.Contains(probe.Error, ErrUnknownPeer.Error()) {
+		t.Errorf("probe = %+v, want it refused before any transfer", probe)
+	}
+	if n, _ := client.Exists(context.Background(), checker.keys.throughputLockKey()).Result(); n != 0 {
+		t.Error("throughput lock taken for an unknown peer")
+	}
+}
@@ -0,0 +1,92 @@
+package liveness
+
+import (
+	"context"
+	"fmt"
+	redisclient "github.com/archa347/ps-network-test/redis"
+	log "github.com/sirupsen/logrus"
+	"time"
+)
+
+type RedisStats struct {
+	Ping       time.Duration
+	RoundTrip  time.Duration
+	TotalConns uint32
+	IdleConns  uint32
+	StaleConns uint32
+	Hits       uint32
+	Misses     uint32
+	Timeouts   uint32
+	Connects   uint64
+}
+
+func (s RedisStats) String() string {
+	return fmt.Sprintf("ping=%v set/get=%v pool(total=%v idle=%v stale=%v hits=%v misses=%v timeouts=%v) connects=%v",
+		round(s.Ping), round(s.RoundTrip), s.TotalConns, s.IdleConns, s.StaleConns, s.Hits, s.Misses, s.Timeouts, s.Connects)
+}
+
+func (c *Checker) probeRedis(ctx context.Context) (RedisStats, error) {
+	var stats RedisStats
+
+	start := time.Now()
+	err := c.redis.Ping(ctx).Err()
+	stats.Ping = time.Since(start)
+	if err != nil {
+		return stats, fmt.Errorf("ping: %w", err)
+	}
+
+	value := timeTag()
+	start = time.Now()
+	err = c.redis.Set(ctx, c.keys.redisProbeKey(c.dyno), value, time.Minute).Err()
+	if err != nil {
+		return stats, fmt.Errorf("set: %w", err)
+	}
+	got, err := c.redis.Get(ctx, c.keys.redisProbeKey(c.dyno)).Result()
+	stats.RoundTrip = time.Since(start)
+	if err != nil {
+		return stats, fmt.Errorf("get: %w", err)
+	}
+	if got != value {
+		return stats, fmt.Errorf("get: read %q after writing %q", got, value)
+	}
+
+	pool := c.redis.PoolStats()
+	stats.TotalConns = pool.TotalConns
+	stats.IdleConns = pool.IdleConns
+	stats.StaleConns = pool.StaleConns
+	stats.Hits = pool.Hits
+	stats.Misses = pool.Misses
+	stats.Timeouts = pool.Timeouts
+	stats.Connects = redisclient.Connects()
+	return stats, nil
+}
+
+// CheckRedis records redis itself as a dependency, so gaps in the report can
+// be told apart from redis being slow.  The measurements are also logged in
+// l2met form so log-based metrics pick them up.
+func (c *Checker) CheckRedis(ctx context.Context) {
+	stats, err := c.probeRedis(ctx)
+
+	var result string
+	switch {
+	case err != nil:
+		result = failResult(err)
+	case stats.Ping > c.redisLatencyWarn || stats.RoundTrip > c.redisLatencyWarn:
+		result = fmt.Sprintf("warn:%v:%v", stats, timeTag())
+	default:
+		result = fmt.Sprintf("pass:%v:%v", stats, timeTag())
+	}
+
+	log.WithFields(log.Fields{
+		"fn":                         "Reporter.CheckRedis",
+		"result":                     result,
+		"measure#redis.ping":         fmt.Sprintf("%.3fms", float64(stats.Ping)/float64(time.Millisecond)),
+		"measure#redis.roundtrip":    fmt.Sprintf("%.3fms", float64(stats.RoundTrip)/float64(time.Millisecond)),
+		"sample#redis.pool.total":    stats.TotalConns,
+		"sample#redis.pool.idle":     stats.IdleConns,
+		"sample#redis.pool.timeouts": stats.Timeouts,
+		"sample#redis.connects":      stats.Connects,
+	}).Info()
+
+	c.storeResult(ctx, "redis", "redis", result)
+}
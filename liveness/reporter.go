@@ -4,58 +4,59 @@ import (
 	"context"
 	"fmt"
 	"github.com/archa347/ps-network-test/config"
-	"github.com/go-redis/redis/v8"
+	redisclient "github.com/archa347/ps-network-test/redis"
 	log "github.com/sirupsen/logrus"
+	"sync"
 	"time"
 )
 
 type Reporter struct {
 	dyno       string
-	redis      *redis.Client
+	keys       keyspace
+	redis      redisclient.Store
 	intervalMS int
 	timeoutMS  int
+	buffer     *WriteBuffer
+	ntpServer  string
+
+	ntpMu sync.Mutex
+	ntp   ClockOffset
 }
 
-func NewReporter(cfg config.Config, client *redis.Client) *Reporter {
+func NewReporter(cfg config.Config, client redisclient.Store, buffer *WriteBuffer) *Reporter {
 	return &Reporter{
 		dyno:       cfg.DynoID,
+		keys:       keyspace(cfg.Namespace),
 		redis:      client,
 		intervalMS: cfg.LivenessIntervalMS,
 		timeoutMS:  cfg.LivenessTimeoutMS,
+		buffer:     buffer,
+		ntpServer:  cfg.NTPServer,
 	}
 }
 
 func (l *Reporter) ReportDMZ(ctx context.Context) {
-	_, err := l.redis.Set(ctx, l.dmzReportKey(), fmt.Sprintf("healthy:%v", timeTag()), 0).Result()
+	_, err := l.redis.Set(ctx, l.keys.dmzKey(l.dyno), fmt.Sprintf("healthy:%v", timeTag()), 0).Result()
 	if err != nil {
 		log.WithError(err).Error("Unable to report DMZ health to redis")
 	}
 }
 
 func (l *Reporter) ReportPrivate(ctx context.Context) {
-	_, err := l.redis.Set(ctx, l.privateReportKey(), fmt.Sprintf("healthy:%v", timeTag()), 0).Result()
+	_, err := l.redis.Set(ctx, l.keys.privateKey(l.dyno), fmt.Sprintf("healthy:%v", timeTag()), 0).Result()
 	if err != nil {
 		log.WithError(err).Error("Unable to report Private health to redis")
 	}
 }
 
-func (l *Reporter) dmzReportKey() string {
-	return fmt.Sprintf("dmz:%v", l.dyno)
-}
-
-func (l *Reporter) privateReportKey() string {
-	return fmt.Sprintf("private:%v", l.dyno)
-}
-
 func (l *Reporter) Start() {
 	ch := make(chan byte)
 
 	go l.consumer(ch)
 	go l.producer(ch)
-}
-
-func (l *Reporter) livenessKey() string {
-	return fmt.Sprintf("liveness:%v", l.dyno)
+	if l.ntpServer != "" {
+		go l.measureNTP()
+	}
 }
 
 func (l *Reporter) consumer(ch chan byte) {
@@ -63,14 +64,22 @@ func (l *Reporter) consumer(ch chan byte) {
 	logger := log.WithField("at", "Reporter.consumer").WithField("dyno", l.dyno)
 	for _ = range ch {
 		logger.Infof("Reporting liveness")
-		_, err := l.redis.Set(ctx, l.livenessKey(), fmt.Sprintf("healthy:%v", timeTag()), 1*time.Minute).Result()
+		added, err := l.buffer.SetMember(ctx, l.keys.livenessKey(l.dyno), fmt.Sprintf("healthy:%v", timeTag()), 1*time.Minute,
+			l.keys.dynosKey(), l.dyno)
 		if err != nil {
 			logger.WithError(err).Error("Error reporting liveness")
 			continue
 		}
-		_, err = l.redis.SAdd(ctx, "dynos", l.dyno).Result()
+		if added {
+			publishEvent(ctx, l.redis, l.keys, membershipEvent(l.dyno, "joined"))
+		}
+		err = l.reportClock(ctx)
+		if err != nil {
+			logger.WithError(err).Error("Unable to report clock offset")
+		}
+		_, err = l.redis.SAdd(ctx, namespacesKey, string(l.keys)).Result()
 		if err != nil {
-			logger.WithError(err).Error("error adding dyno to live dynos list")
+			logger.WithError(err).Error("error adding namespace to namespaces list")
 		}
 	}
 }
@@ -0,0 +1,426 @@
+package liveness
+
+import (
+	"context"
+	"fmt"
+	redisclient "github.com/archa347/ps-network-test/redis"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// SchemaVersion is the key layout this code writes.  Version 1 kept every key
+// at the top level of redis (`dynos`, `liveness:<dyno>`,
+// `nat:src:<dyno>:dest:<url>`, ...); version 2 puts them under a namespace,
+// hash tags dyno IDs and indexes each dyno's results.
+const SchemaVersion = 2
+
+var legacyPatterns = []string{
+	"dynos",
+	"settings:NATCheckURL",
+	"throughput:lock",
+	"liveness:*",
+	"dmz:*",
+	"private:*",
+	"outages:*",
+	"redisprobe:*",
+	"dns:answers:*",
+	"*:src:*",
+}
+
+// legacyKey is a version 1 key, parsed into what it holds.
+type legacyKey struct {
+	key        string
+	kind       string
+	dyno       string
+	resultType string
+	dest       string
+}
+
+func legacyDyno(tagged string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(tagged, "{"), "}")
+}
+
+func parseLegacyKey(key string) (legacyKey, bool) {
+	switch key {
+	case "dynos", "settings:NATCheckURL", "throughput:lock":
+		return legacyKey{key: key, kind: key}, true
+	}
+	if strings.HasPrefix(key, "dns:answers:") {
+		return legacyKey{key: key, kind: "dns:answers", dest: strings.TrimPrefix(key, "dns:answers:")}, true
+	}
+	if rest := strings.TrimPrefix(key, "latency:history:src:"); rest != key {
+		dyno, dest, ok := strings.Cut(rest, ":dest:")
+		return legacyKey{key: key, kind: "latency:history", dyno: legacyDyno(dyno), dest: dest}, ok
+	}
+	prefix, rest, ok := strings.Cut(key, ":")
+	if !ok {
+		return legacyKey{}, false
+	}
+	switch prefix {
+	case "liveness", "dmz", "private", "outages", "redisprobe":
+		return legacyKey{key: key, kind: prefix, dyno: legacyDyno(rest)}, true
+	}
+	rest = strings.TrimPrefix(rest, "src:")
+	if rest == strings.TrimPrefix(key, prefix+":") {
+		return legacyKey{}, false
+	}
+	dyno, dest, ok := strings.Cut(rest, ":dest:")
+	return legacyKey{key: key, kind: "result", dyno: legacyDyno(dyno), resultType: prefix, dest: dest}, ok
+}
+
+// newKey is where a version 1 key lives in version 2, plus the index set and
+// member it should be registered in, if any.
+func (k keyspace) newKey(old legacyKey) (key string, index string, member string) {
+	switch old.kind {
+	case "dynos":
+		return k.dynosKey(), "", ""
+	case "settings:NATCheckURL":
+		return k.natCheckURLKey(), "", ""
+	case "throughput:lock":
+		return k.throughputLockKey(), "", ""
+	case "dns:answers":
+		return k.dnsAnswersKey(old.dest), k.dnsNamesKey(), old.dest
+	case "latency:history":
+		return k.latencyHistoryKey(old.dyno, old.dest), "", ""
+	case "liveness":
+		return k.livenessKey(old.dyno), "", ""
+	case "dmz":
+		return k.dmzKey(old.dyno), "", ""
+	case "private":
+		return k.privateKey(old.dyno), "", ""
+	case "outages":
+		return k.outagesKey(old.dyno), "", ""
+	case "redisprobe":
+		return k.redisProbeKey(old.dyno), "", ""
+	}
+	return k.checkKey(old.resultType, old.dyno, old.dest), k.resultsIndexKey(old.dyno), resultsIndexMember(old.resultType, old.dest)
+}
+
+func scanLegacyKeys(ctx context.Context, client redisclient.Store) ([]legacyKey, error) {
+	seen := make(map[string]bool)
+	var keys []legacyKey
+	for _, pattern := range legacyPatterns {
+		found, err := redisclient.ScanKeys(ctx, client, pattern)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range found {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			old, ok := parseLegacyKey(key)
+			if ok {
+				keys = append(keys, old)
+			}
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key < keys[j].key })
+	return keys, nil
+}
+
+// legacyDynosRemain reports whether any dyno is still heartbeating in the
+// version 1 layout.  Heartbeats expire, unlike some version 1 keys, so this
+// is what says the old release has gone.
+func legacyDynosRemain(legacy []legacyKey) bool {
+	for _, old := range legacy {
+		if old.kind == "liveness" {
+			return true
+		}
+	}
+	return false
+}
+
+func schemaVersion(ctx context.Context, client redisclient.Store, keys keyspace) (int, error) {
+	value, err := client.Get(ctx, keys.schemaVersionKey()).Result()
+	if err == redis.Nil {
+		return 1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Migration moves one version 1 key to its version 2 name.
+type Migration struct {
+	From  string
+	To    string
+	Index string
+}
+
+func (m Migration) String() string {
+	if m.Index != "" {
+		return fmt.Sprintf("%v -> %v (indexed in %v)", m.From, m.To, m.Index)
+	}
+	return fmt.Sprintf("%v -> %v", m.From, m.To)
+}
+
+// PlanMigration lists the moves needed to bring namespace up to
+// SchemaVersion.  It's empty once the namespace has been migrated.
+func PlanMigration(ctx context.Context, client redisclient.Store, namespace string) ([]Migration, error) {
+	keys := keyspace(namespace)
+	version, err := schemaVersion(ctx, client, keys)
+	if err != nil {
+		return nil, err
+	}
+	if version >= SchemaVersion {
+		return nil, nil
+	}
+
+	legacy, err := scanLegacyKeys(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	for _, old := range legacy {
+		key, index, _ := keys.newKey(old)
+		migrations = append(migrations, Migration{From: old.key, To: key, Index: index})
+	}
+	return migrations, nil
+}
+
+// Migrate copies every version 1 key into namespace, keeping its TTL, then
+// deletes the original and records the new schema version.  Keys already
+// written by upgraded dynos are newer than their version 1 counterparts and
+// are left alone, and sets are merged rather than replaced.  Keys are moved
+// one at a time with DUMP and RESTORE since, in a cluster, the old and new
+// names are usually in different slots, so running it again after a partial
+// failure picks up where it stopped.
+func Migrate(ctx context.Context, client redisclient.Store, namespace string) (int, error) {
+	keys := keyspace(namespace)
+	version, err := schemaVersion(ctx, client, keys)
+	if err != nil {
+		return 0, err
+	}
+	if version >= SchemaVersion {
+		return 0, nil
+	}
+
+	legacy, err := scanLegacyKeys(ctx, client)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, old := range legacy {
+		err = migrateKey(ctx, client, keys, old)
+		if err != nil {
+			return moved, fmt.Errorf("migrating %v: %w", old.key, err)
+		}
+		moved++
+	}
+
+	return moved, recordSchemaVersion(ctx, client, keys)
+}
+
+func recordSchemaVersion(ctx context.Context, client redisclient.Store, keys keyspace) error {
+	pipe := client.Pipeline()
+	pipe.SAdd(ctx, namespacesKey, string(keys))
+	pipe.Set(ctx, keys.schemaVersionKey(), SchemaVersion, 0)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// InitSchema records the current schema version for a namespace with
+// nothing to migrate, which is every fresh install, so the report never goes
+// looking for version 1 data.  A namespace with version 1 data is left for
+// cmd/migrate.
+func InitSchema(ctx context.Context, client redisclient.Store, namespace string) error {
+	keys := keyspace(namespace)
+	version, err := schemaVersion(ctx, client, keys)
+	if err != nil || version >= SchemaVersion {
+		return err
+	}
+	legacy, err := scanLegacyKeys(ctx, client)
+	if err != nil {
+		return err
+	}
+	if len(legacy) > 0 {
+		log.WithField("keys", len(legacy)).Warn("Redis holds data from before namespacing; run bin/migrate once every dyno is upgraded")
+		return nil
+	}
+	return recordSchemaVersion(ctx, client, keys)
+}
+
+func migrateKey(ctx context.Context, client redisclient.Store, keys keyspace, old legacyKey) error {
+	key, index, member := keys.newKey(old)
+
+	if old.kind == "dynos" {
+		dynos, err := client.SMembers(ctx, old.key).Result()
+		if err != nil {
+			return err
+		}
+		if len(dynos) > 0 {
+			members := make([]interface{}, len(dynos))
+			for i, dyno := range dynos {
+				members[i] = dyno
+			}
+			err = client.SAdd(ctx, key, members...).Err()
+			if err != nil {
+				return err
+			}
+		}
+		return client.Del(ctx, old.key).Err()
+	}
+
+	dump, err := client.Dump(ctx, old.key).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ttl, err := client.PTTL(ctx, old.key).Result()
+	if err != nil {
+		return err
+	}
+	if ttl == -2 {
+		// Expired between DUMP and PTTL.
+		return nil
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	exists, err := client.Exists(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		err = client.Restore(ctx, key, ttl, dump).Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYKEY") {
+			return err
+		}
+	}
+	if index != "" {
+		err = client.SAdd(ctx, index, member).Err()
+		if err != nil {
+			return err
+		}
+	}
+	return client.Del(ctx, old.key).Err()
+}
+
+// unmigrated reports whether the namespace is still in transition from the
+// version 1 layout, so dynos on an older release may still be writing to it.
+// A namespace never goes back once migrated, so that's remembered rather
+// than read on every call.
+func (c *Checker) unmigrated(ctx context.Context) bool {
+	if c.keys == unnamespaced || atomic.LoadUint32(&c.migrated) == 1 {
+		return false
+	}
+	version, err := schemaVersion(ctx, c.redis, c.keys)
+	if err != nil {
+		log.WithError(err).Warn("Unable to read schema version")
+		return false
+	}
+	if version >= SchemaVersion {
+		atomic.StoreUint32(&c.migrated, 1)
+		return false
+	}
+	return true
+}
+
+// unmigratedDynos returns the live dynos heartbeating in the unnamespaced
+// layout that aren't in known, so checks and the report span both sides of
+// a rolling deploy.
+func (c *Checker) unmigratedDynos(ctx context.Context, known []string, opts readOptions) []string {
+	seen := make(map[string]bool)
+	for _, dyno := range known {
+		seen[dyno] = true
+	}
+	var dynos []string
+	for _, dyno := range c.readDynos(ctx, unnamespaced, opts) {
+		if !seen[dyno] {
+			dynos = append(dynos, dyno)
+		}
+	}
+	return dynos
+}
+
+// legacyReports reads results still in the version 1 layout, for dynos from
+// before a deploy that haven't restarted yet or a namespace that hasn't been
+// migrated.  Dynos from the release just before namespacing index their
+// results, so those are read the same way as current ones; anything older
+// has to be scanned for, as version 1 did.  Neither is done once the
+// namespace's schema version says the migration has run, or once the last
+// old dyno has stopped.
+func (c *Checker) legacyReports(ctx context.Context, current []Report, opts readOptions) []Report {
+	if !c.unmigrated(ctx) {
+		return nil
+	}
+
+	var currentDynos []string
+	for _, report := range current {
+		currentDynos = append(currentDynos, report.Dyno)
+	}
+	indexed := c.readReports(ctx, unnamespaced, c.unmigratedDynos(ctx, currentDynos, opts), opts)
+
+	legacy, err := scanLegacyKeys(ctx, c.redis)
+	if err != nil {
+		log.WithError(err).Warn("Unable to fetch legacy results from redis")
+		return indexed
+	}
+	if !legacyDynosRemain(legacy) {
+		// The last old dyno has gone, so nothing writes the old layout any
+		// more and there's no reason to scan again.  Keys that never expire,
+		// like settings, can outlive it; with none of those either there's
+		// nothing left to migrate, otherwise they're left for cmd/migrate.
+		atomic.StoreUint32(&c.migrated, 1)
+		if len(legacy) > 0 {
+			log.WithField("keys", len(legacy)).Warn("Redis still holds data from before namespacing; run bin/migrate")
+			return indexed
+		}
+		if !opts.prune {
+			return nil
+		}
+		err = recordSchemaVersion(ctx, c.redis, c.keys)
+		if err != nil {
+			log.WithError(err).Warn("Unable to record schema version")
+		}
+		return nil
+	}
+
+	known := make(map[string]bool)
+	for _, dyno := range currentDynos {
+		known[dyno] = true
+	}
+	for _, report := range indexed {
+		known[report.Dyno] = true
+	}
+	byDyno := make(map[string]*Report)
+	var dynos []string
+	for _, old := range legacy {
+		if old.kind == "liveness" && !known[old.dyno] {
+			byDyno[old.dyno] = &Report{Dyno: old.dyno}
+			dynos = append(dynos, old.dyno)
+		}
+	}
+	sort.Strings(dynos)
+
+	for _, old := range legacy {
+		report, ok := byDyno[old.dyno]
+		if !ok || (old.kind != "result" && old.kind != "dmz") {
+			continue
+		}
+		value, err := c.redis.Get(ctx, old.key).Result()
+		if err != nil {
+			continue
+		}
+		if old.kind == "dmz" {
+			report.DMZ = append(report.DMZ, CheckReport{Result: value})
+			continue
+		}
+		report.Add(old.resultType, CheckReport{Dest: old.dest, Result: value})
+	}
+
+	reports := indexed
+	for _, dyno := range dynos {
+		reports = append(reports, *byDyno[dyno])
+	}
+	return reports
+}
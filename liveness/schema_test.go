@@ -0,0 +1,111 @@
+package liveness
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRollingDeploySpansLayouts(t *testing.T) {
+	_, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	ctx := context.Background()
+
+	// web.2 is still on the release before namespacing.
+	heartbeat(t, client, checker.keys, "web.1")
+	heartbeat(t, client, unnamespaced, "web.2")
+	pipe := client.TxPipeline()
+	pipe.Set(ctx, unnamespaced.checkKey("private", "web.2", "web.1"), "pass:"+timeTag(), time.Minute)
+	pipe.SAdd(ctx, unnamespaced.resultsIndexKey("web.2"), resultsIndexMember("private", "web.1"))
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := unnamespaced.livenessKey("web.2"); key != "liveness:{web.2}" {
+		t.Fatalf("unnamespaced liveness key is %v", key)
+	}
+
+	if peers := checker.getPeers(ctx); !reflect.DeepEqual(peers, []string{"web.1", "web.2"}) {
+		t.Errorf("peers = %v, want both releases' dynos", peers)
+	}
+	current := checker.dynoReports(ctx, checker.keys, checker.getDynos(ctx, checker.keys))
+	legacy := checker.legacyReports(ctx, current, checker.localRead())
+	if len(legacy) != 1 || legacy[0].Dyno != "web.2" || len(legacy[0].Private) != 1 || !legacy[0].Private[0].Passed() {
+		t.Errorf("legacy reports = %+v, want web.2's private result", legacy)
+	}
+
+	// Once migrated, only the namespace is read.
+	client.Set(ctx, checker.keys.schemaVersionKey(), SchemaVersion, 0)
+	if peers := checker.getPeers(ctx); !reflect.DeepEqual(peers, []string{"web.1"}) {
+		t.Errorf("peers after migration = %v, want web.1", peers)
+	}
+	if legacy := checker.legacyReports(ctx, current, checker.localRead()); len(legacy) != 0 {
+		t.Errorf("legacy reports after migration = %+v", legacy)
+	}
+}
+
+func TestInitSchema(t *testing.T) {
+	_, client := newTestStore(t)
+	ctx := context.Background()
+
+	client.Set(ctx, "liveness:{web.2}", "healthy", time.Minute)
+	err := InitSchema(ctx, client, "myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := schemaVersion(ctx, client, keyspace("myapp")); version != 1 {
+		t.Errorf("version %v recorded with version 1 data present", version)
+	}
+
+	client.Del(ctx, "liveness:{web.2}")
+	err = InitSchema(ctx, client, "myapp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := schemaVersion(ctx, client, keyspace("myapp")); version != SchemaVersion {
+		t.Errorf("fresh install left at version %v", version)
+	}
+}
+
+func TestLegacyReportsStopOnceLegacyDataIsGone(t *testing.T) {
+	server, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	ctx := context.Background()
+
+	heartbeat(t, client, unnamespaced, "web.2")
+	if !checker.unmigrated(ctx) {
+		t.Fatal("namespace with version 1 data reported as migrated")
+	}
+	checker.legacyReports(ctx, nil, checker.localRead())
+
+	// web.2 stops and its heartbeat expires.
+	server.FastForward(2 * time.Minute)
+	checker.legacyReports(ctx, nil, checker.localRead())
+	if checker.unmigrated(ctx) {
+		t.Error("still scanning for version 1 data after it's gone")
+	}
+	if version, _ := schemaVersion(ctx, client, checker.keys); version != SchemaVersion {
+		t.Errorf("version %v recorded, want %v", version, SchemaVersion)
+	}
+}
+
+func TestLegacyReportsStopWhenOnlyPersistentKeysRemain(t *testing.T) {
+	server, client := newTestStore(t)
+	checker := newTestChecker(t, client, "web.1")
+	ctx := context.Background()
+
+	heartbeat(t, client, unnamespaced, "web.2")
+	client.Set(ctx, "settings:NATCheckURL", "https://example.com", 0)
+	checker.legacyReports(ctx, nil, checker.localRead())
+
+	// web.2 stops, but the setting never expires.
+	server.FastForward(2 * time.Minute)
+	checker.legacyReports(ctx, nil, checker.localRead())
+	if checker.unmigrated(ctx) {
+		t.Error("still scanning for version 1 data after the last old dyno stopped")
+	}
+	if version, _ := schemaVersion(ctx, client, checker.keys); version != 1 {
+		t.Errorf("version %v recorded with the setting left to migrate", version)
+	}
+}
@@ -0,0 +1,182 @@
+package liveness
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	"github.com/carlmjohnson/requests"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultStepMaxBytes bounds how much of each step's response is kept for
+// assertions and variable extraction when the step doesn't set max_bytes.
+// Anything beyond it is dropped rather than failing the step.
+const defaultStepMaxBytes = 1 << 20
+
+var scriptVariable = regexp.MustCompile(`\$\{([A-Za-z0-9_]+)\}`)
+
+type StepError struct {
+	Index int
+	Name  string
+	Err   error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("step %v (%v): %v", e.Index+1, e.Name, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+type StepTiming struct {
+	Name     string
+	Duration time.Duration
+}
+
+func runScript(ctx context.Context, target config.Target, client *http.Client) ([]StepTiming, error) {
+	vars := make(map[string]string)
+	var timings []StepTiming
+	for i, step := range target.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("step%v", i+1)
+		}
+		start := time.Now()
+		err := runStep(ctx, step, vars, client)
+		timings = append(timings, StepTiming{Name: name, Duration: time.Since(start)})
+		if err != nil {
+			return timings, &StepError{Index: i, Name: name, Err: err}
+		}
+	}
+	return timings, nil
+}
+
+func runStep(ctx context.Context, step config.Step, vars map[string]string, client *http.Client) error {
+	url, err := expand(step.URL, vars)
+	if err != nil {
+		return err
+	}
+	method := step.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	rb := requests.URL(url).
+		Method(method).
+		Client(client).
+		AddValidator(func(res *http.Response) error {
+			return checkStatus(step.Assert, res)
+		}).
+		AddValidator(func(res *http.Response) error {
+			return checkHeaders(step.Assert, res)
+		})
+	for name, value := range step.Headers {
+		value, err = expand(value, vars)
+		if err != nil {
+			return err
+		}
+		rb.Header(name, value)
+	}
+	if step.Body != "" {
+		body, err := expand(step.Body, vars)
+		if err != nil {
+			return err
+		}
+		rb.BodyBytes([]byte(body))
+	}
+
+	rb.Handle(func(res *http.Response) error {
+		body, err := readStepBody(step.Assert, res)
+		if err != nil {
+			return err
+		}
+		err = checkBody(step.Assert, body)
+		if err != nil {
+			return err
+		}
+		return extract(step.Extract, res, body, vars)
+	})
+
+	return rb.Fetch(ctx)
+}
+
+func readStepBody(a config.Assertions, res *http.Response) ([]byte, error) {
+	if a.MaxBytes > 0 {
+		return readBody(a, res)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, defaultStepMaxBytes))
+}
+
+func expand(s string, vars map[string]string) (string, error) {
+	var missing string
+	expanded := scriptVariable.ReplaceAllStringFunc(s, func(match string) string {
+		name := scriptVariable.FindStringSubmatch(match)[1]
+		value, ok := vars[name]
+		if !ok && missing == "" {
+			missing = name
+		}
+		return value
+	})
+	if missing != "" {
+		return "", fmt.Errorf("undefined variable %q", missing)
+	}
+	return expanded, nil
+}
+
+func extract(specs map[string]string, res *http.Response, body []byte, vars map[string]string) error {
+	var doc interface{}
+	for name, spec := range specs {
+		source, arg, _ := strings.Cut(spec, ":")
+		switch source {
+		case "json":
+			if doc == nil {
+				err := json.Unmarshal(body, &doc)
+				if err != nil {
+					return assertionFailed("extract", "%v: body is not JSON: %v", name, err)
+				}
+			}
+			value, ok := jsonPath(doc, arg)
+			if !ok {
+				return assertionFailed("extract", "%v: %v not found", name, arg)
+			}
+			if s, ok := value.(string); ok {
+				vars[name] = s
+			} else {
+				vars[name] = jsonString(value)
+			}
+		case "header":
+			value := res.Header.Get(arg)
+			if value == "" {
+				return assertionFailed("extract", "%v: header %v missing", name, arg)
+			}
+			vars[name] = value
+		case "regex":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return assertionFailed("extract", "%v: invalid regex %q: %v", name, arg, err)
+			}
+			match := re.FindSubmatch(body)
+			if match == nil {
+				return assertionFailed("extract", "%v: %q did not match", name, arg)
+			}
+			vars[name] = string(match[len(match)-1])
+		default:
+			return assertionFailed("extract", "%v: unknown source %q", name, spec)
+		}
+	}
+	return nil
+}
+
+func formatTimings(timings []StepTiming) string {
+	parts := make([]string, 0, len(timings))
+	for _, timing := range timings {
+		parts = append(parts, fmt.Sprintf("%v=%v", timing.Name, timing.Duration.Round(time.Millisecond)))
+	}
+	return strings.Join(parts, " ")
+}
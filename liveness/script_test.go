@@ -0,0 +1,162 @@
+package liveness
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scriptServer(t *testing.T) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("X-Session", "s-42")
+		fmt.Fprint(w, `{"data": {"token": "t-123", "ids": [7, 8]}}`)
+	})
+	mux.HandleFunc("/items/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer t-123" || r.Header.Get("X-Session") != "s-42" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"id": %q, "status": "ok"}`, strings.TrimPrefix(r.URL.Path, "/items/"))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("x", defaultStepMaxBytes+1024))
+	})
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRunScriptThreadsExtractedVariables(t *testing.T) {
+	server := scriptServer(t)
+	target := config.Target{
+		Name: "login-flow",
+		Type: config.TargetScript,
+		Steps: []config.Step{
+			{
+				Name:   "login",
+				URL:    server.URL + "/login",
+				Method: http.MethodPost,
+				Extract: map[string]string{
+					"token":   "json:data.token",
+					"id":      "json:data.ids.1",
+					"session": "header:X-Session",
+				},
+			},
+			{
+				Name: "item",
+				URL:  server.URL + "/items/${id}",
+				Headers: map[string]string{
+					"Authorization": "Bearer ${token}",
+					"X-Session":     "${session}",
+				},
+				Assert: config.Assertions{
+					JSON: map[string]interface{}{"id": "8", "status": "ok"},
+				},
+			},
+		},
+	}
+
+	timings, err := runScript(context.Background(), target, http.DefaultClient)
+	if err != nil {
+		t.Fatalf("runScript: %v", err)
+	}
+	if len(timings) != 2 || timings[0].Name != "login" || timings[1].Name != "item" {
+		t.Errorf("timings = %+v, want login and item", timings)
+	}
+}
+
+func TestRunScriptReportsFailingStep(t *testing.T) {
+	server := scriptServer(t)
+	tests := []struct {
+		name      string
+		steps     []config.Step
+		wantIndex int
+		wantClass string
+	}{
+		{
+			name: "status",
+			steps: []config.Step{
+				{URL: server.URL + "/login"},
+			},
+			wantIndex: 0,
+			wantClass: "status",
+		},
+		{
+			name: "undefined variable",
+			steps: []config.Step{
+				{URL: server.URL + "/login", Method: http.MethodPost},
+				{URL: server.URL + "/items/${missing}"},
+			},
+			wantIndex: 1,
+		},
+		{
+			name: "extract",
+			steps: []config.Step{
+				{URL: server.URL + "/login", Method: http.MethodPost, Extract: map[string]string{"x": "json:data.nope"}},
+			},
+			wantIndex: 0,
+			wantClass: "extract",
+		},
+		{
+			name: "unauthorized",
+			steps: []config.Step{
+				{URL: server.URL + "/login", Method: http.MethodPost},
+				{URL: server.URL + "/items/1"},
+			},
+			wantIndex: 1,
+			wantClass: "status",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := config.Target{Name: tt.name, Type: config.TargetScript, Steps: tt.steps}
+			timings, err := runScript(context.Background(), target, http.DefaultClient)
+			var stepErr *StepError
+			if !errors.As(err, &stepErr) {
+				t.Fatalf("err = %v, want a StepError", err)
+			}
+			if stepErr.Index != tt.wantIndex {
+				t.Errorf("failed at step %v, want %v", stepErr.Index, tt.wantIndex)
+			}
+			if len(timings) != tt.wantIndex+1 {
+				t.Errorf("got %v timings, want %v", len(timings), tt.wantIndex+1)
+			}
+			var assertionErr *AssertionError
+			if tt.wantClass != "" && (!errors.As(err, &assertionErr) || assertionErr.Assertion != tt.wantClass) {
+				t.Errorf("err = %v, want a %v assertion", err, tt.wantClass)
+			}
+		})
+	}
+}
+
+func TestRunScriptLargeResponses(t *testing.T) {
+	server := scriptServer(t)
+
+	unbounded := config.Target{Name: "large", Type: config.TargetScript, Steps: []config.Step{
+		{URL: server.URL + "/large", Assert: config.Assertions{BodyContains: "x"}},
+	}}
+	_, err := runScript(context.Background(), unbounded, http.DefaultClient)
+	if err != nil {
+		t.Errorf("response over the default limit failed without max_bytes: %v", err)
+	}
+
+	bounded := config.Target{Name: "large", Type: config.TargetScript, Steps: []config.Step{
+		{URL: server.URL + "/large", Assert: config.Assertions{MaxBytes: 1024}},
+	}}
+	_, err = runScript(context.Background(), bounded, http.DefaultClient)
+	var assertionErr *AssertionError
+	if !errors.As(err, &assertionErr) || assertionErr.Assertion != "max_bytes" {
+		t.Errorf("err = %v, want a max_bytes assertion", err)
+	}
+}
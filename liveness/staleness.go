@@ -0,0 +1,136 @@
+package liveness
+
+import (
+	"github.com/archa347/ps-network-test/config"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"regexp"
+	"time"
+)
+
+// staleGrace covers a check taking a while to get round every destination.
+const staleGrace = 30 * time.Second
+
+var cronParser = cron.NewParser(cron.Second | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// cronInterval is the longest gap between a schedule's next few runs, so an
+// uneven schedule like "0 0,5 * * * *" isn't expected more often than it runs.
+func cronInterval(spec string) (time.Duration, bool) {
+	schedule, err := cronParser.Parse(spec)
+	if err != nil {
+		return 0, false
+	}
+	var longest time.Duration
+	t := schedule.Next(time.Now())
+	for i := 0; i < 5; i++ {
+		next := schedule.Next(t)
+		if next.Sub(t) > longest {
+			longest = next.Sub(t)
+		}
+		t = next
+	}
+	return longest, true
+}
+
+// staleAfter is how old each type of result can get before the check that
+// writes it has missed two runs.  Types without a schedule, like manual
+// probes or throughput when it's only run on demand, are never stale.
+func staleAfter(cfg config.Config) map[string]time.Duration {
+	schedules := map[string][]string{
+		"dmz":     {cfg.DMZCheckCron},
+		"nat":     {cfg.NATCheckCron},
+		"private": {cfg.PrivateCheckCron},
+		"udp":     {cfg.UDPCheckCron},
+		"latency": {cfg.LatencyCheckCron},
+		"redis":   {cfg.RedisCheckCron},
+		// Certificates are recorded by whichever HTTPS check saw them.
+		"cert": {cfg.NATCheckCron, cfg.DMZCheckCron, cfg.PrivateCheckCron},
+	}
+	if len(cfg.DNSResolvers) > 0 {
+		schedules["dns"] = []string{cfg.DNSCheckCron}
+	}
+	if cfg.ThroughputCron != "" {
+		schedules["throughput"] = []string{cfg.ThroughputCron}
+	}
+
+	limits := make(map[string]time.Duration)
+	for resultType, specs := range schedules {
+		var longest time.Duration
+		for _, spec := range specs {
+			interval, ok := cronInterval(spec)
+			if !ok {
+				log.WithField("type", resultType).WithField("cron", spec).Warn("Unable to parse check schedule")
+				continue
+			}
+			if interval > longest {
+				longest = interval
+			}
+		}
+		if longest > 0 {
+			limits[resultType] = 2*longest + staleGrace
+		}
+	}
+	return limits
+}
+
+// Age is how long ago a result was recorded.  It's text like "1m30s" in JSON
+// rather than a count of nanoseconds.
+type Age time.Duration
+
+func (a Age) String() string {
+	return time.Duration(a).String()
+}
+
+func (a Age) MarshalText() ([]byte, error) {
+	return []byte(a.String()), nil
+}
+
+func (a *Age) UnmarshalText(text []byte) error {
+	d, err := time.ParseDuration(string(text))
+	*a = Age(d)
+	return err
+}
+
+var resultTimePattern = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2})$`)
+
+// resultTime is the time tag every result ends with.
+func resultTime(result string) (time.Time, bool) {
+	tag := resultTimePattern.FindString(result)
+	if tag == "" {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339, tag)
+	return t, err == nil
+}
+
+// Dated reports whether the result carries the time it was recorded, and so
+// has an Age.
+func (r *CheckReport) Dated() bool {
+	_, ok := resultTime(r.Result)
+	return ok
+}
+
+// markStale sets check's age and whether it's past the limit in staleAfter
+// for its type.  Types without a limit are never stale.
+func markStale(staleAfter map[string]time.Duration, resultType string, check *CheckReport, now time.Time) {
+	t, ok := resultTime(check.Result)
+	if !ok {
+		return
+	}
+	age := now.Sub(t).Round(time.Second)
+	check.Age = Age(age)
+	limit, ok := staleAfter[resultType]
+	check.Stale = ok && age > limit
+}
+
+// producerStaleAfter is how long a dyno that runs checks can go without
+// storing any result: the limit of its most frequent check.
+func (c *Checker) producerStaleAfter() time.Duration {
+	var shortest time.Duration
+	for _, limit := range c.staleAfter {
+		if shortest == 0 || limit < shortest {
+			shortest = limit
+		}
+	}
+	return shortest
+}
@@ -0,0 +1,72 @@
+package liveness
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestMarkStale(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	staleAfter := map[string]time.Duration{"udp": 2*time.Minute + staleGrace}
+
+	tests := []struct {
+		name       string
+		check      CheckReport
+		resultType string
+		wantAge    Age
+		wantStale  bool
+	}{
+		{
+			name:       "fresh",
+			check:      CheckReport{Result: "pass:2024-05-01T11:59:30Z"},
+			resultType: "udp",
+			wantAge:    Age(30 * time.Second),
+		},
+		{
+			name:       "stale",
+			check:      CheckReport{Result: "pass:2024-05-01T11:55:00Z"},
+			resultType: "udp",
+			wantAge:    Age(5 * time.Minute),
+			wantStale:  true,
+		},
+		{
+			name:       "unscheduled",
+			check:      CheckReport{Result: "pass:2024-05-01T11:00:00Z"},
+			resultType: "manual",
+			wantAge:    Age(time.Hour),
+		},
+		{
+			name:       "undated",
+			check:      CheckReport{Result: "healthy"},
+			resultType: "udp",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			check := tt.check
+			markStale(staleAfter, tt.resultType, &check, now)
+			if check.Age != tt.wantAge || check.Stale != tt.wantStale {
+				t.Errorf("age = %v, stale = %v, want %v, %v", check.Age, check.Stale, tt.wantAge, tt.wantStale)
+			}
+		})
+	}
+}
+
+func TestAgeJSON(t *testing.T) {
+	encoded, err := json.Marshal(CheckReport{Result: "pass", Age: Age(90 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(encoded, &fields)
+	if fields["Age"] != "1m30s" {
+		t.Errorf("Age encoded as %v, want 1m30s", fields["Age"])
+	}
+
+	var check CheckReport
+	err = json.Unmarshal(encoded, &check)
+	if err != nil || check.Age != Age(90*time.Second) {
+		t.Errorf("decoded %v, %v", check.Age, err)
+	}
+}
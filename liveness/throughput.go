@@ -0,0 +1,292 @@
+package liveness
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"time"
+)
+
+const maxThroughputBytes = 1 << 30
+
+var ErrThroughputBusy = errors.New("another throughput test is running")
+
+var ErrUnknownPeer = errors.New("not a known peer")
+
+// releaseLock only deletes the lock if we still hold it, so a test that ran
+// past its TTL can't release a lock another dyno has since taken.
+var releaseLock = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+type ThroughputStats struct {
+	UpBytes   int64
+	Up        time.Duration
+	DownBytes int64
+	Down      time.Duration
+}
+
+func mbps(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / d.Seconds() / 1e6
+}
+
+func (s ThroughputStats) String() string {
+	return fmt.Sprintf("up=%.1fMbps down=%.1fMbps (%.1fMB up, %.1fMB down)",
+		mbps(s.UpBytes, s.Up), mbps(s.DownBytes, s.Down), float64(s.UpBytes)/1e6, float64(s.DownBytes)/1e6)
+}
+
+// The throughput service speaks a minimal protocol over its own TCP port: the
+// client sends a direction byte and a big-endian byte count, then either
+// streams that many bytes up ('U'), half-closing early if its time runs out,
+// and reads back how many arrived, or reads that many bytes down ('D') until
+// it hangs up.
+const (
+	throughputUp   = 'U'
+	throughputDown = 'D'
+)
+
+// throughputConnTimeout bounds a single connection, so a client that stops
+// reading or writing can't hold a handler forever.
+const throughputConnTimeout = 2 * time.Minute
+
+// ServeThroughput runs the throughput sink and source on addr, behind the
+// private listener's TLS when tlsConfig is set.
+func ServeThroughput(addr string, tlsConfig *tls.Config) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	defer listener.Close()
+	return serveThroughput(listener)
+}
+
+func serveThroughput(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go handleThroughput(conn)
+	}
+}
+
+func handleThroughput(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(throughputConnTimeout))
+	logger := log.WithField("peer", conn.RemoteAddr().String())
+
+	header := make([]byte, 9)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		logger.WithError(err).Debug("Unable to read throughput request")
+		return
+	}
+	size := int64(binary.BigEndian.Uint64(header[1:]))
+	if size <= 0 || size > maxThroughputBytes {
+		logger.WithField("bytes", size).Warn("Throughput request out of range")
+		return
+	}
+	switch header[0] {
+	case throughputUp:
+		n, err := io.Copy(io.Discard, io.LimitReader(conn, size))
+		if err != nil {
+			logger.WithError(err).Debug("Throughput upload ended early")
+		}
+		binary.Write(conn, binary.BigEndian, n)
+	case throughputDown:
+		io.CopyN(conn, zeroReader{}, size)
+	default:
+		logger.WithField("direction", header[0]).Warn("Unknown throughput request")
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// CheckThroughput runs an on-demand test against peer, which must be one of
+// the peers the checks would probe anyway so a caller can't point the
+// transfer at an arbitrary host.
+func (c *Checker) CheckThroughput(ctx context.Context, peer string) (string, error) {
+	err := c.knownPeer(ctx, peer)
+	if err != nil {
+		return "", err
+	}
+	return c.checkThroughput(ctx, peer)
+}
+
+// knownPeer returns ErrUnknownPeer unless peer is one of the peers the checks
+// probe, other than this dyno.
+func (c *Checker) knownPeer(ctx context.Context, peer string) error {
+	for _, known := range c.getPeers(ctx) {
+		if peer == known && peer != c.dyno && peer != c.privateIP {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %q", ErrUnknownPeer, peer)
+}
+
+// checkThroughput transfers up to c.throughputBytes each way to the peer's
+// throughput service, stopping each direction early when c.throughputTimeout
+// runs out.  Only one test runs across the whole cluster at a time.
+func (c *Checker) checkThroughput(ctx context.Context, peer string) (string, error) {
+	logger := log.WithFields(log.Fields{
+		"fn":   "Reporter.CheckThroughput",
+		"peer": peer,
+	})
+
+	release, err := c.lockThroughput(ctx)
+	if err != nil {
+		logger.WithError(err).Info("Unable to take throughput lock")
+		return "", err
+	}
+	defer release()
+
+	stats, err := c.measureThroughput(ctx, peer)
+	var result string
+	if err != nil {
+		result = failResult(err)
+	} else {
+		result = fmt.Sprintf("pass:%v:%v", stats, timeTag())
+	}
+	logger.WithField("result", result).Info()
+
+	return result, c.storeResult(ctx, "throughput", peer, result)
+}
+
+// lockThroughput takes the cluster-wide throughput lock, returning a func
+// that releases it.
+func (c *Checker) lockThroughput(ctx context.Context) (func(), error) {
+	lockTTL := 2*c.throughputTimeout + 10*time.Second
+	locked, err := c.redis.SetNX(ctx, c.keys.throughputLockKey(), c.dyno, lockTTL).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !locked {
+		holder, _ := c.redis.Get(ctx, c.keys.throughputLockKey()).Result()
+		return nil, fmt.Errorf("%w on %v", ErrThroughputBusy, holder)
+	}
+	return func() {
+		releaseLock.Run(context.Background(), c.redis, []string{c.keys.throughputLockKey()}, c.dyno)
+	}, nil
+}
+
+func (c *Checker) measureThroughput(ctx context.Context, peer string) (ThroughputStats, error) {
+	var stats ThroughputStats
+	addr := net.JoinHostPort(peer, c.throughputPort)
+
+	// The context is only a backstop; transfers stop themselves at the
+	// deadline so a slow path still produces a measurement.
+	ctx, cancel := context.WithTimeout(ctx, 2*c.throughputTimeout+5*time.Second)
+	defer cancel()
+
+	conn, err := c.dialThroughput(ctx, addr, throughputUp)
+	if err != nil {
+		return stats, fmt.Errorf("upload: %w", err)
+	}
+	start := time.Now()
+	body := &deadlineReader{r: io.LimitReader(zeroReader{}, c.throughputBytes), deadline: start.Add(c.throughputTimeout)}
+	_, err = io.Copy(conn, body)
+	if closer, ok := conn.(interface{ CloseWrite() error }); ok && err == nil {
+		err = closer.CloseWrite()
+	}
+	if err == nil {
+		err = binary.Read(conn, binary.BigEndian, &stats.UpBytes)
+	}
+	stats.Up = time.Since(start)
+	conn.Close()
+	if err != nil {
+		return stats, fmt.Errorf("upload: %w", err)
+	}
+
+	conn, err = c.dialThroughput(ctx, addr, throughputDown)
+	if err != nil {
+		return stats, fmt.Errorf("download: %w", err)
+	}
+	defer conn.Close()
+	start = time.Now()
+	download := &deadlineReader{r: conn, deadline: start.Add(c.throughputTimeout)}
+	_, err = io.Copy(io.Discard, download)
+	stats.Down, stats.DownBytes = time.Since(start), download.n
+	if err != nil {
+		return stats, fmt.Errorf("download: %w", err)
+	}
+	return stats, nil
+}
+
+// dialThroughput connects to a peer's throughput service, over TLS when the
+// private listener uses it, and sends the request header.
+func (c *Checker) dialThroughput(ctx context.Context, addr string, direction byte) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if c.privateTLS != nil {
+		dialer := &tls.Dialer{Config: c.privateTLS}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	header := make([]byte, 9)
+	header[0] = direction
+	binary.BigEndian.PutUint64(header[1:], uint64(c.throughputBytes))
+	_, err = conn.Write(header)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// deadlineReader ends the stream at the deadline and counts what got through.
+type deadlineReader struct {
+	r        io.Reader
+	deadline time.Time
+	n        int64
+}
+
+func (r *deadlineReader) Read(p []byte) (int, error) {
+	if time.Now().After(r.deadline) {
+		return 0, io.EOF
+	}
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+func (c *Checker) checkThroughputAll(ctx context.Context) {
+	for _, dyno := range c.getPeers(ctx) {
+		if dyno == c.dyno || dyno == c.privateIP {
+			continue
+		}
+		_, err := c.checkThroughput(ctx, dyno)
+		if errors.Is(err, ErrThroughputBusy) {
+			return
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package liveness
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startThroughput serves the throughput service on loopback, over TLS when
+// tlsConfig is set, and returns its port.
+func startThroughput(t *testing.T, tlsConfig *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go serveThroughput(listener)
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	return port
+}
+
+// testTLS returns server and client configs that trust each other, for
+// 127.0.0.1.
+func testTLS(t *testing.T) (*tls.Config, *tls.Config) {
+	server := httptest.NewUnstartedServer(http.NotFoundHandler())
+	server.StartTLS()
+	defer server.Close()
+	client := server.Client().Transport.(*http.Transport).TLSClientConfig
+	return server.TLS.Clone(), client.Clone()
+}
+
+func TestMeasureThroughput(t *testing.T) {
+	serverTLS, clientTLS := testTLS(t)
+	tests := []struct {
+		name      string
+		serverTLS *tls.Config
+		clientTLS *tls.Config
+	}{
+		{name: "plain"},
+		{name: "tls", serverTLS: serverTLS, clientTLS: clientTLS},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := &Checker{
+				throughputPort:    startThroughput(t, tt.serverTLS),
+				throughputBytes:   1 << 20,
+				throughputTimeout: 5 * time.Second,
+				privateTLS:        tt.clientTLS,
+			}
+			stats, err := checker.measureThroughput(context.Background(), "127.0.0.1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.UpBytes != 1<<20 || stats.DownBytes != 1<<20 {
+				t.Errorf("moved %v up and %v down, want %v each way", stats.UpBytes, stats.DownBytes, 1<<20)
+			}
+			if stats.Up <= 0 || stats.Down <= 0 {
+				t.Errorf("durations = %v up, %v down", stats.Up, stats.Down)
+			}
+		})
+	}
+}
+
+func TestMeasureThroughputStopsAtDeadline(t *testing.T) {
+	checker := &Checker{
+		throughputPort:    startThroughput(t, nil),
+		throughputBytes:   maxThroughputBytes,
+		throughputTimeout: 20 * time.Millisecond,
+	}
+	start := time.Now()
+	stats, err := checker.measureThroughput(context.Background(), "127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %v with a 20ms limit each way", elapsed)
+	}
+	// The sink reports what actually arrived, not what was announced.
+	if stats.UpBytes <= 0 || stats.UpBytes >= maxThroughputBytes || stats.DownBytes <= 0 || stats.DownBytes >= maxThroughputBytes {
+		t.Errorf("stats = %+v, want partial transfers", stats)
+	}
+}
+
+func TestThroughputRejectsBadRequests(t *testing.T) {
+	port := startThroughput(t, nil)
+	for _, header := range [][]byte{
+		{throughputDown, 0, 0, 0, 0, 0, 0, 0, 0},
+		{throughputDown, 0xff, 0, 0, 0, 0, 0, 0, 0},
+		{'X', 0, 0, 0, 0, 0, 0, 0, 1},
+	} {
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write(header)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if n, _ := conn.Read(make([]byte, 1)); n != 0 {
+			t.Errorf("request %v got a response", header)
+		}
+		conn.Close()
+	}
+}
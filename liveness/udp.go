@@ -0,0 +1,181 @@
+package liveness
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+)
+
+const udpPacketSize = 24
+
+// udpDuplicateGrace is how long probeUDP keeps listening once every packet
+// has come back, so duplicates of the last ones are still counted.
+const udpDuplicateGrace = 100 * time.Millisecond
+
+var udpMagic = []byte("PSNT")
+
+func ServeUDPEcho(addr string) error {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	return serveUDPEcho(conn)
+}
+
+func serveUDPEcho(conn net.PacketConn) error {
+	buf := make([]byte, 1500)
+	for {
+		n, peer, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n != udpPacketSize || string(buf[:4]) != string(udpMagic) {
+			continue
+		}
+		_, err = conn.WriteTo(buf[:n], peer)
+		if err != nil {
+			log.WithError(err).WithField("peer", peer.String()).Warn("Unable to echo UDP packet")
+		}
+	}
+}
+
+type UDPStats struct {
+	Sent       int
+	Received   int
+	Duplicates int
+	Reordered  int
+	RTT        time.Duration
+	Jitter     time.Duration
+}
+
+func (s UDPStats) Loss() float64 {
+	if s.Sent == 0 {
+		return 0
+	}
+	return float64(s.Sent-s.Received) / float64(s.Sent)
+}
+
+func (s UDPStats) String() string {
+	return fmt.Sprintf("loss=%.1f%% reordered=%v duplicates=%v rtt=%v jitter=%v",
+		s.Loss()*100, s.Reordered, s.Duplicates, s.RTT.Round(time.Microsecond), s.Jitter.Round(time.Microsecond))
+}
+
+// probeUDP sends count sequenced packets to an echo responder and accounts for
+// what comes back.  Jitter is the mean difference between consecutive RTTs.
+func probeUDP(ctx context.Context, addr string, count int, interval time.Duration, wait time.Duration) (UDPStats, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return UDPStats{}, err
+	}
+	defer conn.Close()
+
+	probeID := rand.Uint32()
+	sendErr := make(chan error, 1)
+	go func() {
+		packet := make([]byte, udpPacketSize)
+		copy(packet, udpMagic)
+		binary.BigEndian.PutUint32(packet[4:], probeID)
+		for seq := 0; seq < count; seq++ {
+			binary.BigEndian.PutUint32(packet[8:], uint32(seq))
+			binary.BigEndian.PutUint64(packet[12:], uint64(time.Now().UnixNano()))
+			_, err := conn.Write(packet)
+			if err != nil {
+				sendErr <- err
+				return
+			}
+			time.Sleep(interval)
+		}
+		sendErr <- nil
+	}()
+
+	stats := UDPStats{Sent: count}
+	seen := make([]bool, count)
+	highest := -1
+	var rtts []time.Duration
+	deadline := time.Now().Add(time.Duration(count)*interval + wait)
+	conn.SetReadDeadline(deadline)
+	buf := make([]byte, 1500)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			// Connection refused and friends surface here on a connected
+			// socket; keep listening until the deadline in case they're transient.
+			if time.Now().After(deadline) {
+				break
+			}
+			continue
+		}
+		received := time.Now()
+		if n != udpPacketSize || string(buf[:4]) != string(udpMagic) || binary.BigEndian.Uint32(buf[4:]) != probeID {
+			continue
+		}
+		seq := int(binary.BigEndian.Uint32(buf[8:]))
+		if seq >= count {
+			continue
+		}
+		if seen[seq] {
+			stats.Duplicates++
+			continue
+		}
+		seen[seq] = true
+		stats.Received++
+		if stats.Received == count {
+			if grace := received.Add(udpDuplicateGrace); grace.Before(deadline) {
+				deadline = grace
+				conn.SetReadDeadline(deadline)
+			}
+		}
+		if seq < highest {
+			stats.Reordered++
+		} else {
+			highest = seq
+		}
+		sentAt := time.Unix(0, int64(binary.BigEndian.Uint64(buf[12:])))
+		rtts = append(rtts, received.Sub(sentAt))
+	}
+
+	err = <-sendErr
+	if err != nil {
+		return stats, err
+	}
+
+	var total, variation time.Duration
+	for i, rtt := range rtts {
+		total += rtt
+		if i > 0 {
+			variation += time.Duration(math.Abs(float64(rtt - rtts[i-1])))
+		}
+	}
+	if len(rtts) > 0 {
+		stats.RTT = total / time.Duration(len(rtts))
+	}
+	if len(rtts) > 1 {
+		stats.Jitter = variation / time.Duration(len(rtts)-1)
+	}
+	return stats, nil
+}
+
+func udpResult(stats UDPStats, err error) string {
+	switch {
+	case err != nil:
+		return failResult(err)
+	case stats.Received == 0:
+		return fmt.Sprintf("fail:%v:%v", stats, timeTag())
+	case stats.Received < stats.Sent:
+		return fmt.Sprintf("warn:%v:%v", stats, timeTag())
+	default:
+		return fmt.Sprintf("pass:%v:%v", stats, timeTag())
+	}
+}
@@ -0,0 +1,165 @@
+package liveness
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenUDP starts a loopback UDP socket closed with the test.
+func listenUDP(t *testing.T) net.PacketConn {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// fakeEcho answers each packet with whatever respond returns, so tests can
+// drop, duplicate or hold back echoes.
+func fakeEcho(t *testing.T, respond func(seq int, packet []byte) [][]byte) string {
+	conn := listenUDP(t)
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packet := append([]byte(nil), buf[:n]...)
+			for _, reply := range respond(int(binary.BigEndian.Uint32(packet[8:])), packet) {
+				conn.WriteTo(reply, peer)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestProbeUDP(t *testing.T) {
+	const count = 10
+	var held []byte
+	tests := []struct {
+		name    string
+		respond func(seq int, packet []byte) [][]byte
+		want    UDPStats
+		state   string
+	}{
+		{
+			name:    "clean",
+			respond: func(seq int, packet []byte) [][]byte { return [][]byte{packet} },
+			want:    UDPStats{Sent: count, Received: count},
+			state:   "pass",
+		},
+		{
+			// The last packet's duplicate arrives after every packet has
+			// been seen once.
+			name:    "duplicated",
+			respond: func(seq int, packet []byte) [][]byte { return [][]byte{packet, packet} },
+			want:    UDPStats{Sent: count, Received: count, Duplicates: count},
+			state:   "pass",
+		},
+		{
+			name: "lossy",
+			respond: func(seq int, packet []byte) [][]byte {
+				if seq%2 == 1 {
+					return nil
+				}
+				return [][]byte{packet}
+			},
+			want:  UDPStats{Sent: count, Received: count / 2},
+			state: "warn",
+		},
+		{
+			name: "reordered",
+			respond: func(seq int, packet []byte) [][]byte {
+				switch seq {
+				case 3:
+					held = packet
+					return nil
+				case 4:
+					return [][]byte{packet, held}
+				}
+				return [][]byte{packet}
+			},
+			want:  UDPStats{Sent: count, Received: count, Reordered: 1},
+			state: "pass",
+		},
+		{
+			name:    "silent",
+			respond: func(seq int, packet []byte) [][]byte { return nil },
+			want:    UDPStats{Sent: count},
+			state:   "fail",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := fakeEcho(t, tt.respond)
+			stats, err := probeUDP(context.Background(), addr, count, time.Millisecond, 200*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := stats
+			got.RTT, got.Jitter = 0, 0
+			if got != tt.want {
+				t.Errorf("stats = %+v, want %+v", got, tt.want)
+			}
+			if stats.Received > 0 && stats.RTT <= 0 {
+				t.Errorf("rtt = %v for %v echoes", stats.RTT, stats.Received)
+			}
+			if result := udpResult(stats, nil); !strings.HasPrefix(result, tt.state+":") {
+				t.Errorf("result = %v, want %v", result, tt.state)
+			}
+		})
+	}
+}
+
+func TestServeUDPEcho(t *testing.T) {
+	conn := listenUDP(t)
+	go serveUDPEcho(conn)
+
+	stats, err := probeUDP(context.Background(), conn.LocalAddr().String(), 20, time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Received != 20 || stats.Loss() != 0 {
+		t.Errorf("stats = %+v, want every packet echoed", stats)
+	}
+
+	// Anything that isn't a probe packet is ignored.
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write([]byte("hello"))
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := client.Read(make([]byte, 1500)); err == nil {
+		t.Errorf("echoed a %v byte non-probe packet", n)
+	}
+}
+
+func TestUDPResult(t *testing.T) {
+	tests := []struct {
+		name  string
+		stats UDPStats
+		err   error
+		want  string
+	}{
+		{name: "all back", stats: UDPStats{Sent: 10, Received: 10}, want: "pass:loss=0.0%"},
+		{name: "some lost", stats: UDPStats{Sent: 10, Received: 9}, want: "warn:loss=10.0%"},
+		{name: "none back", stats: UDPStats{Sent: 10}, want: "fail:loss=100.0%"},
+		{name: "send failed", err: errors.New("connection refused"), want: "fail:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := udpResult(tt.stats, tt.err); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("got %v, want prefix %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package mtls
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/archa347/ps-network-test/config"
+)
+
+type Config struct {
+	Server *tls.Config
+	Client *tls.Config
+}
+
+func (c Config) Enabled() bool {
+	return c.Server != nil
+}
+
+func Load(cfg config.Config) (Config, error) {
+	if !cfg.PrivateTLS {
+		return Config{}, nil
+	}
+
+	cert, err := tls.X509KeyPair([]byte(cfg.PrivateTLSCert), []byte(cfg.PrivateTLSKey))
+	if err != nil {
+		return Config{}, fmt.Errorf("unable to load private TLS key pair: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(cfg.PrivateTLSCA)) {
+		return Config{}, errors.New("no certificates found in PRIVATE_TLS_CA")
+	}
+
+	return Config{
+		Server: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+		Client: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			RootCAs:      pool,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, nil
+}
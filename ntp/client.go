@@ -0,0 +1,96 @@
+package ntp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// ntpEpochOffset is the number of seconds between the NTP epoch (1900) and
+// the Unix epoch (1970).
+const ntpEpochOffset = 2208988800
+
+const packetSize = 48
+
+type Response struct {
+	// Offset is how far the local clock is behind the server's: add it to
+	// local time to get server time.
+	Offset  time.Duration
+	RTT     time.Duration
+	Stratum uint8
+}
+
+// Query sends one SNTPv4 client request to server, "host" or "host:port",
+// and works out the local clock's offset from the four timestamps as in RFC
+// 4330.
+func Query(ctx context.Context, server string) (Response, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", server)
+	if err != nil {
+		return Response{}, err
+	}
+	defer conn.Close()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(5 * time.Second)
+	}
+	conn.SetDeadline(deadline)
+
+	req := make([]byte, packetSize)
+	// LI 0, version 4, mode 3 (client).
+	req[0] = 0<<6 | 4<<3 | 3
+	sent := time.Now()
+	putTimestamp(req[40:], sent)
+	_, err = conn.Write(req)
+	if err != nil {
+		return Response{}, err
+	}
+
+	resp := make([]byte, packetSize)
+	n, err := conn.Read(resp)
+	received := time.Now()
+	if err != nil {
+		return Response{}, err
+	}
+	if n < packetSize {
+		return Response{}, errors.New("short NTP response")
+	}
+	if mode := resp[0] & 0x7; mode != 4 {
+		return Response{}, fmt.Errorf("unexpected NTP mode %v", mode)
+	}
+	stratum := resp[1]
+	if stratum == 0 {
+		return Response{}, fmt.Errorf("NTP kiss-o'-death %q", resp[12:16])
+	}
+	if string(resp[24:32]) != string(req[40:48]) {
+		return Response{}, errors.New("NTP response doesn't match request")
+	}
+
+	serverReceived := timestamp(resp[32:])
+	serverSent := timestamp(resp[40:])
+	return Response{
+		Offset:  (serverReceived.Sub(sent) + serverSent.Sub(received)) / 2,
+		RTT:     received.Sub(sent) - serverSent.Sub(serverReceived),
+		Stratum: stratum,
+	}, nil
+}
+
+func putTimestamp(b []byte, t time.Time) {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	binary.BigEndian.PutUint32(b[0:], uint32(seconds))
+	binary.BigEndian.PutUint32(b[4:], uint32(fraction))
+}
+
+func timestamp(b []byte) time.Time {
+	seconds := int64(binary.BigEndian.Uint32(b[0:])) - ntpEpochOffset
+	fraction := uint64(binary.BigEndian.Uint32(b[4:]))
+	return time.Unix(seconds, int64(fraction*uint64(time.Second)>>32))
+}
@@ -0,0 +1,174 @@
+package ntp
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestServer answers every request with respond's reply, or not at all if
+// it returns nil.
+func newTestServer(t *testing.T, respond func(req []byte) []byte) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, peer, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if resp := respond(buf[:n]); resp != nil {
+				conn.WriteTo(resp, peer)
+			}
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// reply is a server's answer to req from a clock offset ahead of the local
+// one.
+func reply(req []byte, offset time.Duration, stratum uint8) []byte {
+	resp := make([]byte, packetSize)
+	// LI 0, version 4, mode 4 (server).
+	resp[0] = 0<<6 | 4<<3 | 4
+	resp[1] = stratum
+	copy(resp[24:32], req[40:48])
+	now := time.Now().Add(offset)
+	putTimestamp(resp[32:], now)
+	putTimestamp(resp[40:], now)
+	return resp
+}
+
+func TestQuery(t *testing.T) {
+	for _, offset := range []time.Duration{5 * time.Second, -3 * time.Second, 0} {
+		t.Run(offset.String(), func(t *testing.T) {
+			server := newTestServer(t, func(req []byte) []byte {
+				return reply(req, offset, 2)
+			})
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			resp, err := Query(ctx, server)
+			if err != nil {
+				t.Fatalf("Query: %v", err)
+			}
+			if diff := resp.Offset - offset; diff < -50*time.Millisecond || diff > 50*time.Millisecond {
+				t.Errorf("offset = %v, want about %v", resp.Offset, offset)
+			}
+			if resp.RTT < 0 || resp.RTT > 50*time.Millisecond {
+				t.Errorf("rtt = %v", resp.RTT)
+			}
+			if resp.Stratum != 2 {
+				t.Errorf("stratum = %v, want 2", resp.Stratum)
+			}
+		})
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		respond func(req []byte) []byte
+		wantErr string
+	}{
+		{
+			name: "kiss-o'-death",
+			respond: func(req []byte) []byte {
+				resp := reply(req, 0, 0)
+				copy(resp[12:16], "RATE")
+				return resp
+			},
+			wantErr: `kiss-o'-death "RATE"`,
+		},
+		{
+			name: "mismatched origin",
+			respond: func(req []byte) []byte {
+				resp := reply(req, 0, 2)
+				binary.BigEndian.PutUint64(resp[24:32], 1)
+				return resp
+			},
+			wantErr: "doesn't match request",
+		},
+		{
+			name: "short packet",
+			respond: func(req []byte) []byte {
+				return reply(req, 0, 2)[:40]
+			},
+			wantErr: "short NTP response",
+		},
+		{
+			name: "client mode",
+			respond: func(req []byte) []byte {
+				return req
+			},
+			wantErr: "unexpected NTP mode 3",
+		},
+		{
+			name: "no answer",
+			respond: func(req []byte) []byte {
+				return nil
+			},
+			wantErr: "timeout",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestServer(t, tt.respond)
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+
+			_, err := Query(ctx, server)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("err = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	tests := []struct {
+		name string
+		t    time.Time
+		want [8]byte
+	}{
+		{
+			name: "unix epoch",
+			t:    time.Unix(0, 0),
+			want: [8]byte{0x83, 0xaa, 0x7e, 0x80, 0, 0, 0, 0},
+		},
+		{
+			name: "half a second",
+			t:    time.Unix(1, int64(time.Second/2)),
+			want: [8]byte{0x83, 0xaa, 0x7e, 0x81, 0x80, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b [8]byte
+			putTimestamp(b[:], tt.t)
+			if b != tt.want {
+				t.Errorf("putTimestamp = % x, want % x", b, tt.want)
+			}
+			if got := timestamp(b[:]); !got.Equal(tt.t) {
+				t.Errorf("timestamp = %v, want %v", got, tt.t)
+			}
+		})
+	}
+
+	// The fraction is in units of 2^-32 seconds, so a round trip can lose
+	// part of a nanosecond.
+	now := time.Now()
+	var b [8]byte
+	putTimestamp(b[:], now)
+	if diff := now.Sub(timestamp(b[:])); diff < 0 || diff > time.Nanosecond {
+		t.Errorf("round trip of %v is off by %v", now, diff)
+	}
+}
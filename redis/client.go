@@ -1,21 +1,217 @@
 package redis
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"github.com/archa347/ps-network-test/config"
 	"github.com/go-redis/redis/v8"
 	log "github.com/sirupsen/logrus"
-	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-func RedisClient(config config.Config) *redis.Client {
+const (
+	TLSVerify   = "verify"
+	TLSCA       = "ca"
+	TLSPin      = "pin"
+	TLSInsecure = "insecure"
+)
+
+const (
+	ModeSingle   = "single"
+	ModeSentinel = "sentinel"
+	ModeCluster  = "cluster"
+)
+
+// Store is the part of the go-redis API the app is written against.  Every
+// topology's client satisfies it, so nothing past RedisClient needs to know
+// whether it's talking to a single node, a sentinel-managed primary or a
+// cluster.  Tests satisfy it with a client pointed at a memstore.Server.
+type Store interface {
+	redis.Cmdable
+	Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	PoolStats() *redis.PoolStats
+	Close() error
+}
+
+// RedisClient builds a client for the configured topology.  REDIS_URL always
+// supplies credentials, TLS and database; in sentinel and cluster modes
+// REDIS_ADDRS lists the sentinels or seed nodes, defaulting to the URL's host.
+func RedisClient(config config.Config) (Store, error) {
 	opts, err := redis.ParseURL(config.RedisURL)
 	if err != nil {
-		log.WithError(err).Error("Unable to parse redis url")
-		os.Exit(1)
+		return nil, fmt.Errorf("unable to parse redis url: %w", err)
 	}
 	if opts.TLSConfig != nil {
-		opts.TLSConfig.InsecureSkipVerify = true
+		err = configureTLS(opts.TLSConfig, config)
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure redis TLS (mode %q): %w", config.RedisTLSMode, err)
+		}
+	}
+
+	opts.OnConnect = func(ctx context.Context, cn *redis.Conn) error {
+		atomic.AddUint64(&connects, 1)
+		return nil
+	}
+
+	addrs := config.RedisAddrs
+	if len(addrs) == 0 {
+		addrs = []string{opts.Addr}
+	}
+	universal := &redis.UniversalOptions{
+		Addrs:            addrs,
+		DB:               opts.DB,
+		Username:         opts.Username,
+		Password:         opts.Password,
+		SentinelPassword: config.RedisSentinelPassword,
+		MasterName:       config.RedisMasterName,
+		TLSConfig:        opts.TLSConfig,
+		OnConnect:        opts.OnConnect,
 	}
 
-	return redis.NewClient(opts)
+	switch config.RedisMode {
+	case ModeSingle:
+		return redis.NewClient(opts), nil
+	case ModeSentinel:
+		if config.RedisMasterName == "" {
+			return nil, errors.New("REDIS_MASTER_NAME must be set when REDIS_MODE=sentinel")
+		}
+		return redis.NewFailoverClient(universal.Failover()), nil
+	case ModeCluster:
+		if opts.DB != 0 {
+			return nil, errors.New("redis cluster only supports database 0")
+		}
+		return redis.NewClusterClient(universal.Cluster()), nil
+	default:
+		return nil, fmt.Errorf("unknown REDIS_MODE %q", config.RedisMode)
+	}
+}
+
+// ScanKeys returns every key matching pattern.  A cluster keeps its keys on
+// each master, so every master is scanned rather than whichever node a single
+// SCAN happens to land on.
+func ScanKeys(ctx context.Context, client Store, pattern string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, client, pattern)
+	}
+
+	var mu sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		nodeKeys, err := scanNode(ctx, node, pattern)
+		mu.Lock()
+		keys = append(keys, nodeKeys...)
+		mu.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	var cursor uint64 = 0
+	for {
+		page, next, err := client.Scan(ctx, cursor, pattern, 100).Result()
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, page...)
+		cursor = next
+		if cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// PinMismatchError is returned when the redis server's certificate doesn't
+// match any of the REDIS_TLS_PIN hashes.
+type PinMismatchError struct {
+	Hash string
+}
+
+func (e *PinMismatchError) Error() string {
+	return fmt.Sprintf("redis server certificate SPKI hash %v does not match REDIS_TLS_PIN", e.Hash)
+}
+
+// IsCertificateError reports whether err came from verifying the server's
+// certificate, as opposed to the server being unreachable.
+func IsCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	var pin *PinMismatchError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname) || errors.As(err, &pin)
+}
+
+var connects uint64
+
+// Connects counts the connections the client has opened.  Beyond the initial
+// pool, each one is a reconnect after a connection was dropped or went stale.
+func Connects() uint64 {
+	return atomic.LoadUint64(&connects)
+}
+
+func configureTLS(tlsConfig *tls.Config, config config.Config) error {
+	switch config.RedisTLSMode {
+	case TLSVerify:
+		return nil
+	case TLSCA:
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.RedisTLSCA)) {
+			return errors.New("no certificates found in REDIS_TLS_CA")
+		}
+		tlsConfig.RootCAs = pool
+		return nil
+	case TLSPin:
+		pins, err := parsePins(config.RedisTLSPin)
+		if err != nil {
+			return err
+		}
+		// Chain verification is replaced by the pin check, since pinned
+		// servers typically present self-signed certificates.
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return &PinMismatchError{Hash: "none"}
+			}
+			hash := sha256.Sum256(state.PeerCertificates[0].RawSubjectPublicKeyInfo)
+			if !pins[string(hash[:])] {
+				return &PinMismatchError{Hash: base64.StdEncoding.EncodeToString(hash[:])}
+			}
+			return nil
+		}
+		return nil
+	case TLSInsecure:
+		log.Warn("!!! REDIS_TLS_MODE=insecure: redis server certificates are NOT verified and the connection can be intercepted !!!")
+		tlsConfig.InsecureSkipVerify = true
+		return nil
+	default:
+		return fmt.Errorf("unknown REDIS_TLS_MODE %q", config.RedisTLSMode)
+	}
+}
+
+func parsePins(value string) (map[string]bool, error) {
+	pins := make(map[string]bool)
+	for _, pin := range strings.Split(value, ",") {
+		pin = strings.TrimPrefix(strings.TrimSpace(pin), "sha256/")
+		if pin == "" {
+			continue
+		}
+		hash, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("invalid SPKI pin %q: must be a base64 encoded SHA-256 hash", pin)
+		}
+		pins[string(hash)] = true
+	}
+	if len(pins) == 0 {
+		return nil, errors.New("REDIS_TLS_PIN must be set when REDIS_TLS_MODE=pin")
+	}
+	return pins, nil
 }
@@ -0,0 +1,296 @@
+package redis
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"github.com/archa347/ps-network-test/config"
+	"github.com/archa347/ps-network-test/redis/memstore"
+	"github.com/go-redis/redis/v8"
+	"io"
+	"math/big"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisClientTopology(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.Config
+		wantType string
+		wantAddr string
+		wantErr  bool
+	}{
+		{
+			name:     "single",
+			cfg:      config.Config{RedisURL: "redis://h:6379/2", RedisMode: ModeSingle},
+			wantType: "*redis.Client",
+			wantAddr: "h:6379",
+		},
+		{
+			name: "sentinel",
+			cfg: config.Config{
+				RedisURL:        "redis://:secret@h:6379",
+				RedisMode:       ModeSentinel,
+				RedisAddrs:      []string{"s1:26379", "s2:26379"},
+				RedisMasterName: "mymaster",
+			},
+			wantType: "*redis.Client",
+			wantAddr: "FailoverClient",
+		},
+		{
+			name:    "sentinel without master",
+			cfg:     config.Config{RedisURL: "redis://h:6379", RedisMode: ModeSentinel},
+			wantErr: true,
+		},
+		{
+			name: "cluster",
+			cfg: config.Config{
+				RedisURL:   "redis://h:6379",
+				RedisMode:  ModeCluster,
+				RedisAddrs: []string{"n1:6379", "n2:6379"},
+			},
+			wantType: "*redis.ClusterClient",
+		},
+		{
+			name:    "cluster with database",
+			cfg:     config.Config{RedisURL: "redis://h:6379/3", RedisMode: ModeCluster},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mode",
+			cfg:     config.Config{RedisURL: "redis://h:6379", RedisMode: "ring"},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := RedisClient(tt.cfg)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %T, want an error", client)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			if got := reflect.TypeOf(client).String(); got != tt.wantType {
+				t.Errorf("got %v, want %v", got, tt.wantType)
+			}
+			if single, ok := client.(*redis.Client); ok && single.Options().Addr != tt.wantAddr {
+				t.Errorf("addr = %v, want %v", single.Options().Addr, tt.wantAddr)
+			}
+			if cluster, ok := client.(*redis.ClusterClient); ok {
+				if got := cluster.Options().Addrs; !reflect.DeepEqual(got, tt.cfg.RedisAddrs) {
+					t.Errorf("seed nodes = %v, want %v", got, tt.cfg.RedisAddrs)
+				}
+			}
+		})
+	}
+}
+
+func TestScanKeysSingleNode(t *testing.T) {
+	server, err := memstore.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	client, err := RedisClient(config.Config{RedisURL: "redis://" + server.Addr(), RedisMode: ModeSingle})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	ctx := context.Background()
+	for _, key := range []string{"app:liveness:{web.1}", "app:liveness:{web.2}", "app:dynos"} {
+		client.Set(ctx, key, "x", 0)
+	}
+	keys, err := ScanKeys(ctx, client, "app:liveness:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"app:liveness:{web.1}", "app:liveness:{web.2}"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+}
+
+// tlsStore serves a memstore over TLS with a self-signed certificate for
+// 127.0.0.1, returning its address and the certificate.
+func tlsStore(t *testing.T) (string, *x509.Certificate) {
+	server, err := memstore.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "redis"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				backend, err := net.Dial("tcp", server.Addr())
+				if err != nil {
+					return
+				}
+				defer backend.Close()
+				go io.Copy(backend, conn)
+				io.Copy(conn, backend)
+			}()
+		}
+	}()
+	return listener.Addr().String(), cert
+}
+
+func spkiPin(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func TestTLSModes(t *testing.T) {
+	addr, cert := tlsStore(t)
+	caPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	otherPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	tests := []struct {
+		name     string
+		mode     string
+		ca       string
+		pin      string
+		wantCert bool
+	}{
+		{name: "verify against system roots", mode: TLSVerify, wantCert: true},
+		{name: "ca", mode: TLSCA, ca: caPEM},
+		{name: "pin", mode: TLSPin, pin: "sha256/" + spkiPin(cert)},
+		{name: "one of several pins", mode: TLSPin, pin: otherPin + ", " + spkiPin(cert)},
+		{name: "pin mismatch", mode: TLSPin, pin: otherPin, wantCert: true},
+		{name: "insecure", mode: TLSInsecure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := RedisClient(config.Config{
+				RedisURL:     "rediss://" + addr,
+				RedisMode:    ModeSingle,
+				RedisTLSMode: tt.mode,
+				RedisTLSCA:   tt.ca,
+				RedisTLSPin:  tt.pin,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			err = client.Ping(context.Background()).Err()
+			if tt.wantCert {
+				if !IsCertificateError(err) {
+					t.Errorf("got %v, want a certificate error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("ping: %v", err)
+			}
+		})
+	}
+}
+
+func TestTLSConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.Config
+	}{
+		{name: "ca without certificates", cfg: config.Config{RedisTLSMode: TLSCA, RedisTLSCA: "not a certificate"}},
+		{name: "pin without pins", cfg: config.Config{RedisTLSMode: TLSPin}},
+		{name: "unknown mode", cfg: config.Config{RedisTLSMode: "trust-me"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.cfg.RedisURL = "rediss://127.0.0.1:6379"
+			tt.cfg.RedisMode = ModeSingle
+			if client, err := RedisClient(tt.cfg); err == nil {
+				client.Close()
+				t.Error("got a client, want an error")
+			}
+		})
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	tests := []struct {
+		name    string
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{name: "bare", value: valid, want: 1},
+		{name: "prefixed", value: "sha256/" + valid, want: 1},
+		{name: "list with spaces and blanks", value: " sha256/" + valid + " ,, " + strings.Replace(valid, "A", "B", 1), want: 2},
+		{name: "duplicates", value: valid + "," + valid, want: 1},
+		{name: "empty", value: " , ", wantErr: true},
+		{name: "not base64", value: "sha256/not-base64!", wantErr: true},
+		{name: "wrong length", value: base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pins, err := parsePins(tt.value)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("got %v pins, want an error", len(pins))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(pins) != tt.want {
+				t.Errorf("got %v pins, want %v", len(pins), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,655 @@
+// Package memstore is an in-memory stand-in for a redis server.  It speaks
+// just enough of the protocol, and implements just the commands the app
+// uses, for tests to point a real client at it and exercise the same code
+// paths, pipelines and transactions included, without a redis to talk to.
+package memstore
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type status string
+
+type replyError string
+
+type entry struct {
+	str      *string
+	set      map[string]bool
+	list     []string
+	hash     map[string]string
+	expireAt time.Time
+}
+
+// Server is a single node holding every key in memory.  DUMP/RESTORE and
+// pub/sub subscriptions aren't implemented; PUBLISH is accepted and delivered
+// to nobody.  Lua can't be run, so scripts need a Go stand-in registered with
+// RegisterScript.
+type Server struct {
+	ln net.Listener
+
+	mu      sync.Mutex
+	data    map[string]*entry
+	scripts map[string]Script
+	offset  time.Duration
+	down    bool
+}
+
+// Script stands in for a Lua script.  call runs a command the way
+// redis.call does, and as with a real script nothing else runs until it
+// returns.
+type Script func(call func(args ...string) interface{}, keys []string, args []string) interface{}
+
+// Start listens on a random local port and serves until Close.
+func Start() (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{ln: ln, data: make(map[string]*entry), scripts: make(map[string]Script)}
+	go s.serve()
+	return s, nil
+}
+
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+func (s *Server) Close() error {
+	return s.ln.Close()
+}
+
+// FastForward moves the server's clock on by d, expiring keys and advancing
+// TIME as if that long had passed.
+func (s *Server) FastForward(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset += d
+}
+
+// SetDown makes every command fail, as if redis were unreachable, until it's
+// called again with false.  Connections stay open.
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+}
+
+// RegisterScript runs script for EVAL and EVALSHA of the Lua script whose
+// SHA1 is sha.  Any other script is refused.
+func (s *Server) RegisterScript(sha string, script Script) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[sha] = script
+}
+
+// Keys returns every live key, sorted.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.data {
+		if s.lookup(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) now() time.Time {
+	return time.Now().Add(s.offset)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+
+	var queued [][]string
+	inMulti := false
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		s.mu.Lock()
+		down := s.down
+		s.mu.Unlock()
+
+		var reply interface{}
+		switch name := strings.ToLower(args[0]); {
+		case down:
+			inMulti, queued = false, nil
+			reply = errDown
+		case name == "multi":
+			inMulti, queued = true, nil
+			reply = status("OK")
+		case name == "discard":
+			inMulti, queued = false, nil
+			reply = status("OK")
+		case name == "exec":
+			replies := make([]interface{}, len(queued))
+			s.mu.Lock()
+			for i, cmd := range queued {
+				replies[i] = s.exec(cmd)
+			}
+			s.mu.Unlock()
+			inMulti, queued = false, nil
+			reply = replies
+		case inMulti:
+			queued = append(queued, args)
+			reply = status("QUEUED")
+		default:
+			s.mu.Lock()
+			reply = s.exec(args)
+			s.mu.Unlock()
+		}
+
+		writeReply(w, reply)
+		// Pipelined commands are answered together once the client stops
+		// sending.
+		if r.Buffered() == 0 {
+			if w.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errors.New("expected bulk string")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		_, err = io.ReadFull(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%v\r\n", v)
+	case replyError:
+		fmt.Fprintf(w, "-%v\r\n", v)
+	case int:
+		fmt.Fprintf(w, ":%v\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%v\r\n%v\r\n", len(v), v)
+	case []string:
+		fmt.Fprintf(w, "*%v\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%v\r\n", len(v))
+		for _, item := range v {
+			writeReply(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("memstore: unexpected reply type %T", reply))
+	}
+}
+
+var (
+	errSyntax    = replyError("ERR syntax error")
+	errWrongType = replyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNotInt    = replyError("ERR value is not an integer or out of range")
+	errDown      = replyError("ERR memstore is down")
+)
+
+// lookup returns the live entry for key, dropping it if it has expired.
+// Must be called with s.mu held.
+func (s *Server) lookup(key string) *entry {
+	e, ok := s.data[key]
+	if !ok {
+		return nil
+	}
+	if !e.expireAt.IsZero() && !s.now().Before(e.expireAt) {
+		delete(s.data, key)
+		return nil
+	}
+	return e
+}
+
+// Must be called with s.mu held.
+func (s *Server) exec(args []string) interface{} {
+	name, args := strings.ToLower(args[0]), args[1:]
+	arity, ok := arities[name]
+	if !ok {
+		return replyError(fmt.Sprintf("ERR unknown command '%v'", name))
+	}
+	if len(args) < arity {
+		return replyError(fmt.Sprintf("ERR wrong number of arguments for '%v' command", name))
+	}
+
+	switch name {
+	case "ping":
+		return status("PONG")
+	case "select":
+		return status("OK")
+	case "time":
+		now := s.now()
+		return []string{strconv.FormatInt(now.Unix(), 10), strconv.Itoa(now.Nanosecond() / 1000)}
+	case "publish":
+		return 0
+	case "get":
+		e := s.lookup(args[0])
+		if e == nil {
+			return nil
+		}
+		if e.str == nil {
+			return errWrongType
+		}
+		return *e.str
+	case "mget":
+		values := make([]interface{}, len(args))
+		for i, key := range args {
+			if e := s.lookup(key); e != nil && e.str != nil {
+				values[i] = *e.str
+			}
+		}
+		return values
+	case "set":
+		return s.set(args)
+	case "del":
+		deleted := 0
+		for _, key := range args {
+			if s.lookup(key) != nil {
+				delete(s.data, key)
+				deleted++
+			}
+		}
+		return deleted
+	case "exists":
+		count := 0
+		for _, key := range args {
+			if s.lookup(key) != nil {
+				count++
+			}
+		}
+		return count
+	case "expire", "pexpire":
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return errNotInt
+		}
+		e := s.lookup(args[0])
+		if e == nil {
+			return 0
+		}
+		unit := time.Second
+		if name == "pexpire" {
+			unit = time.Millisecond
+		}
+		e.expireAt = s.now().Add(time.Duration(n) * unit)
+		return 1
+	case "ttl", "pttl":
+		e := s.lookup(args[0])
+		switch {
+		case e == nil:
+			return -2
+		case e.expireAt.IsZero():
+			return -1
+		case name == "pttl":
+			return int(e.expireAt.Sub(s.now()) / time.Millisecond)
+		default:
+			return int(e.expireAt.Sub(s.now()) / time.Second)
+		}
+	case "scan":
+		return s.scan(args)
+	case "sadd", "srem", "smembers", "scard", "sismember":
+		return s.setCommand(name, args)
+	case "lpush", "rpush", "lrange", "ltrim", "llen":
+		return s.listCommand(name, args)
+	case "hset", "hget", "hgetall", "hdel":
+		return s.hashCommand(name, args)
+	case "eval", "evalsha":
+		return s.eval(name, args)
+	}
+	return replyError(fmt.Sprintf("ERR unknown command '%v'", name))
+}
+
+var arities = map[string]int{
+	"ping": 0, "select": 1, "time": 0, "publish": 2,
+	"get": 1, "mget": 1, "set": 2, "del": 1, "exists": 1,
+	"expire": 2, "pexpire": 2, "ttl": 1, "pttl": 1, "scan": 1,
+	"sadd": 2, "srem": 2, "smembers": 1, "scard": 1, "sismember": 2,
+	"lpush": 2, "rpush": 2, "lrange": 3, "ltrim": 3, "llen": 1,
+	"hset": 3, "hget": 2, "hgetall": 1, "hdel": 2,
+	"eval": 2, "evalsha": 2,
+}
+
+// Must be called with s.mu held.
+func (s *Server) eval(name string, args []string) interface{} {
+	sha := args[0]
+	if name == "eval" {
+		sum := sha1.Sum([]byte(args[0]))
+		sha = hex.EncodeToString(sum[:])
+	}
+	script, ok := s.scripts[sha]
+	if !ok && name == "evalsha" {
+		return replyError("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	if !ok {
+		return replyError("ERR memstore can't run Lua without a registered stand-in")
+	}
+	n, err := strconv.Atoi(args[1])
+	if err != nil || n < 0 || n > len(args)-2 {
+		return replyError("ERR Number of keys can't be greater than number of args")
+	}
+	call := func(args ...string) interface{} {
+		return s.exec(args)
+	}
+	return script(call, args[2:2+n], args[2+n:])
+}
+
+func (s *Server) set(args []string) interface{} {
+	key, value := args[0], args[1]
+	var expireAt time.Time
+	nx, xx, keepTTL := false, false, false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		case "keepttl":
+			keepTTL = true
+		case "ex", "px":
+			if i+1 >= len(args) {
+				return errSyntax
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil || n <= 0 {
+				return errNotInt
+			}
+			unit := time.Second
+			if strings.ToLower(args[i]) == "px" {
+				unit = time.Millisecond
+			}
+			expireAt = s.now().Add(time.Duration(n) * unit)
+			i++
+		default:
+			return errSyntax
+		}
+	}
+
+	existing := s.lookup(key)
+	if (nx && existing != nil) || (xx && existing == nil) {
+		return nil
+	}
+	if keepTTL && existing != nil {
+		expireAt = existing.expireAt
+	}
+	s.data[key] = &entry{str: &value, expireAt: expireAt}
+	return status("OK")
+}
+
+func (s *Server) scan(args []string) interface{} {
+	pattern := "*"
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.ToLower(args[i]) == "match" {
+			pattern = args[i+1]
+		}
+	}
+	// Everything comes back in one page, which callers looping until the
+	// cursor returns to 0 handle the same as many.
+	var keys []string
+	for key := range s.data {
+		if matched, _ := path.Match(pattern, key); matched && s.lookup(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	if keys == nil {
+		keys = []string{}
+	}
+	return []interface{}{"0", keys}
+}
+
+func (s *Server) setCommand(name string, args []string) interface{} {
+	key := args[0]
+	e := s.lookup(key)
+	if e != nil && e.set == nil {
+		return errWrongType
+	}
+	switch name {
+	case "sadd":
+		if e == nil {
+			e = &entry{set: make(map[string]bool)}
+			s.data[key] = e
+		}
+		added := 0
+		for _, member := range args[1:] {
+			if !e.set[member] {
+				e.set[member] = true
+				added++
+			}
+		}
+		return added
+	case "srem":
+		if e == nil {
+			return 0
+		}
+		removed := 0
+		for _, member := range args[1:] {
+			if e.set[member] {
+				delete(e.set, member)
+				removed++
+			}
+		}
+		if len(e.set) == 0 {
+			delete(s.data, key)
+		}
+		return removed
+	case "smembers":
+		members := []string{}
+		if e != nil {
+			for member := range e.set {
+				members = append(members, member)
+			}
+		}
+		sort.Strings(members)
+		return members
+	case "scard":
+		if e == nil {
+			return 0
+		}
+		return len(e.set)
+	default:
+		if e != nil && e.set[args[1]] {
+			return 1
+		}
+		return 0
+	}
+}
+
+func (s *Server) listCommand(name string, args []string) interface{} {
+	key := args[0]
+	e := s.lookup(key)
+	if e != nil && e.list == nil {
+		return errWrongType
+	}
+	switch name {
+	case "lpush", "rpush":
+		if e == nil {
+			e = &entry{list: []string{}}
+			s.data[key] = e
+		}
+		for _, value := range args[1:] {
+			if name == "lpush" {
+				e.list = append([]string{value}, e.list...)
+			} else {
+				e.list = append(e.list, value)
+			}
+		}
+		return len(e.list)
+	case "llen":
+		if e == nil {
+			return 0
+		}
+		return len(e.list)
+	}
+
+	start, err1 := strconv.Atoi(args[1])
+	stop, err2 := strconv.Atoi(args[2])
+	if err1 != nil || err2 != nil {
+		return errNotInt
+	}
+	var list []string
+	if e != nil {
+		list = e.list
+	}
+	from, to := listRange(len(list), start, stop)
+	if name == "lrange" {
+		return append([]string{}, list[from:to]...)
+	}
+	if e != nil {
+		e.list = append([]string{}, list[from:to]...)
+		if len(e.list) == 0 {
+			delete(s.data, key)
+		}
+	}
+	return status("OK")
+}
+
+// listRange turns redis's inclusive, possibly negative, indexes into a slice
+// range of a list of length n.
+func listRange(n int, start int, stop int) (int, int) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return 0, 0
+	}
+	return start, stop + 1
+}
+
+func (s *Server) hashCommand(name string, args []string) interface{} {
+	key := args[0]
+	e := s.lookup(key)
+	if e != nil && e.hash == nil {
+		return errWrongType
+	}
+	switch name {
+	case "hset":
+		if len(args)%2 != 1 {
+			return replyError("ERR wrong number of arguments for 'hset' command")
+		}
+		if e == nil {
+			e = &entry{hash: make(map[string]string)}
+			s.data[key] = e
+		}
+		added := 0
+		for i := 1; i < len(args); i += 2 {
+			if _, ok := e.hash[args[i]]; !ok {
+				added++
+			}
+			e.hash[args[i]] = args[i+1]
+		}
+		return added
+	case "hget":
+		if e == nil {
+			return nil
+		}
+		value, ok := e.hash[args[1]]
+		if !ok {
+			return nil
+		}
+		return value
+	case "hgetall":
+		fields := []string{}
+		if e != nil {
+			for field, value := range e.hash {
+				fields = append(fields, field, value)
+			}
+		}
+		return fields
+	default:
+		if e == nil {
+			return 0
+		}
+		removed := 0
+		for _, field := range args[1:] {
+			if _, ok := e.hash[field]; ok {
+				delete(e.hash, field)
+				removed++
+			}
+		}
+		if len(e.hash) == 0 {
+			delete(s.data, key)
+		}
+		return removed
+	}
+}